@@ -0,0 +1,360 @@
+// Package dn formats, parses and compares X.509 distinguished names.
+//
+// x509-proxy and pwck8s both use it so the same certificate always maps to the same identity:
+// attributes are put in a fixed order and rendered as an RFC 4514 string.
+package dn
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Attribute is a single attribute type and value of a DN
+type Attribute struct {
+	Type  string
+	Value string
+}
+
+// DN is a distinguished name in canonical order, most significant attribute (C) first
+type DN []Attribute
+
+// attributeType describes a known attribute: its short name, OID and position in the canonical order
+type attributeType struct {
+	name string
+	oid  asn1.ObjectIdentifier
+}
+
+// knownTypes lists the supported attributes in canonical order, from most to least significant.
+// Attributes not listed here are ordered after these by their dotted OID.
+var knownTypes = []attributeType{
+	{"DC", asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 25}},
+	{"C", asn1.ObjectIdentifier{2, 5, 4, 6}},
+	{"ST", asn1.ObjectIdentifier{2, 5, 4, 8}},
+	{"L", asn1.ObjectIdentifier{2, 5, 4, 7}},
+	{"STREET", asn1.ObjectIdentifier{2, 5, 4, 9}},
+	{"POSTALCODE", asn1.ObjectIdentifier{2, 5, 4, 17}},
+	{"O", asn1.ObjectIdentifier{2, 5, 4, 10}},
+	{"OU", asn1.ObjectIdentifier{2, 5, 4, 11}},
+	{"T", asn1.ObjectIdentifier{2, 5, 4, 12}},
+	{"SN", asn1.ObjectIdentifier{2, 5, 4, 4}},
+	{"GN", asn1.ObjectIdentifier{2, 5, 4, 42}},
+	{"CN", asn1.ObjectIdentifier{2, 5, 4, 3}},
+	{"SERIALNUMBER", asn1.ObjectIdentifier{2, 5, 4, 5}},
+	{"UID", asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}},
+	{"EMAILADDRESS", asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}},
+}
+
+// typeAliases maps alternative spellings found in the wild to the canonical short name
+var typeAliases = map[string]string{
+	"COMMONNAME":             "CN",
+	"ORGANIZATIONALUNITNAME": "OU",
+	"ORGANIZATIONNAME":       "O",
+	"LOCALITYNAME":           "L",
+	"S":                      "ST",
+	"STATEORPROVINCENAME":    "ST",
+	"COUNTRYNAME":            "C",
+	"STREETADDRESS":          "STREET",
+	"DOMAINCOMPONENT":        "DC",
+	"USERID":                 "UID",
+	"E":                      "EMAILADDRESS",
+	"EMAIL":                  "EMAILADDRESS",
+	"SURNAME":                "SN",
+	"GIVENNAME":              "GN",
+	"TITLE":                  "T",
+}
+
+// CanonicalType returns the canonical short name of an attribute type, such as CN for commonName or 2.5.4.3
+func CanonicalType(t string) string {
+	upper := strings.ToUpper(strings.TrimSpace(t))
+	if alias, ok := typeAliases[upper]; ok {
+		return alias
+	}
+	// Dotted OIDs of known attributes use the short name
+	for _, known := range knownTypes {
+		if upper == known.name || upper == known.oid.String() || upper == "OID."+known.oid.String() {
+			return known.name
+		}
+	}
+	return strings.TrimPrefix(upper, "OID.")
+}
+
+// rank returns the position of an attribute type in the canonical order
+func rank(t string) int {
+	for i, known := range knownTypes {
+		if t == known.name {
+			return i
+		}
+	}
+	return len(knownTypes)
+}
+
+// sortAttributes puts attributes in canonical order, keeping the relative order of repeated types
+func sortAttributes(d DN) {
+	sort.SliceStable(d, func(i, j int) bool {
+		ri, rj := rank(d[i].Type), rank(d[j].Type)
+		if ri != rj {
+			return ri < rj
+		}
+		// Unknown attributes are ordered by OID
+		if ri == len(knownTypes) {
+			return d[i].Type < d[j].Type
+		}
+		return false
+	})
+}
+
+// FromName builds a canonical DN from every attribute of a parsed pkix.Name
+func FromName(name pkix.Name) DN {
+	var d DN
+	if len(name.Names) > 0 {
+		// Names holds every attribute of a parsed certificate, including ones without a pkix.Name field
+		for _, atv := range name.Names {
+			d = append(d, attributeFromASN1(atv))
+		}
+	} else {
+		// Names is only populated by parsing, fall back to the fields (and ExtraNames) for a hand built pkix.Name
+		for _, atv := range name.ToRDNSequence() {
+			for _, a := range atv {
+				d = append(d, attributeFromASN1(a))
+			}
+		}
+	}
+	sortAttributes(d)
+	return d
+}
+
+// FromCertificate returns the canonical subject DN of a certificate
+func FromCertificate(cert *x509.Certificate) DN {
+	if cert == nil {
+		return nil
+	}
+	return FromName(cert.Subject)
+}
+
+// attributeFromASN1 converts a parsed attribute, values that are not strings are kept as #hex DER
+func attributeFromASN1(atv pkix.AttributeTypeAndValue) Attribute {
+	t := CanonicalType(atv.Type.String())
+	if s, ok := atv.Value.(string); ok {
+		return Attribute{Type: t, Value: s}
+	}
+	der, err := asn1.Marshal(atv.Value)
+	if err != nil {
+		return Attribute{Type: t, Value: fmt.Sprint(atv.Value)}
+	}
+	return Attribute{Type: t, Value: "#" + hex.EncodeToString(der)}
+}
+
+// Parse reads a DN in RFC 4514 form (CN=a,OU=b,O=c) or OpenSSL slash form (/O=c/OU=b/CN=a)
+// and returns it in canonical order.
+func Parse(s string) (DN, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, fmt.Errorf("empty DN")
+	}
+
+	var d DN
+	var err error
+	if strings.HasPrefix(s, "/") {
+		d, err = parseSlash(s)
+	} else {
+		d, err = parseRFC4514(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sortAttributes(d)
+	return d, nil
+}
+
+// parseSlash parses the OpenSSL one line format, where / separates attributes
+func parseSlash(s string) (DN, error) {
+	var d DN
+	for _, part := range strings.Split(strings.TrimPrefix(s, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		t, v, found := strings.Cut(part, "=")
+		if !found || strings.TrimSpace(t) == "" {
+			return nil, fmt.Errorf("invalid DN attribute %q", part)
+		}
+		d = append(d, Attribute{Type: CanonicalType(t), Value: strings.TrimSpace(v)})
+	}
+	if len(d) == 0 {
+		return nil, fmt.Errorf("empty DN")
+	}
+	return d, nil
+}
+
+// parseRFC4514 parses a string representation of a DN, multi-valued RDNs (a+b) become separate attributes.
+// The string lists the least significant RDN first, the RDNs are reversed into certificate order
+// so repeated attribute types keep the order FromName gives them.
+func parseRFC4514(s string) (DN, error) {
+	var rdns []DN
+	var rdn DN
+	i := 0
+	for i < len(s) {
+		// Attribute type, up to the =
+		eq := strings.IndexByte(s[i:], '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("invalid DN: missing = after %q", s[i:])
+		}
+		t := strings.TrimSpace(s[i : i+eq])
+		if t == "" {
+			return nil, fmt.Errorf("invalid DN: empty attribute type")
+		}
+		i += eq + 1
+
+		// Attribute value, up to an unescaped , ; or +
+		var value strings.Builder
+		trailing := 0
+		for i < len(s) && s[i] != ',' && s[i] != ';' && s[i] != '+' {
+			c := s[i]
+			if c == '\\' {
+				if i+1 >= len(s) {
+					return nil, fmt.Errorf("invalid DN: trailing escape")
+				}
+				// Either \hh or \<special>
+				if i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+					b, _ := hex.DecodeString(s[i+1 : i+3])
+					value.Write(b)
+					i += 3
+				} else {
+					value.WriteByte(s[i+1])
+					i += 2
+				}
+				trailing = 0
+				continue
+			}
+			// Unescaped spaces around the value are not part of it
+			if c == ' ' {
+				if value.Len() == 0 {
+					i++
+					continue
+				}
+				trailing++
+			} else {
+				trailing = 0
+			}
+			value.WriteByte(c)
+			i++
+		}
+		v := value.String()
+		rdn = append(rdn, Attribute{Type: CanonicalType(t), Value: v[:len(v)-trailing]})
+
+		// Skip the separator, a + continues the RDN
+		if i < len(s) && s[i] == '+' {
+			i++
+			continue
+		}
+		rdns = append(rdns, rdn)
+		rdn = nil
+		if i < len(s) {
+			i++
+		}
+	}
+
+	var d DN
+	for j := len(rdns) - 1; j >= 0; j-- {
+		d = append(d, rdns[j]...)
+	}
+	if len(d) == 0 {
+		return nil, fmt.Errorf("empty DN")
+	}
+	return d, nil
+}
+
+// isHex reports whether c is a hexadecimal digit
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// escapeValue escapes an attribute value as described in RFC 4514 section 2.4
+func escapeValue(v string) string {
+	// Values that are already hex encoded DER are written as is
+	if strings.HasPrefix(v, "#") && len(v) > 1 && isHexString(v[1:]) {
+		return v
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c == '"' || c == '+' || c == ',' || c == ';' || c == '<' || c == '>' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString("\\00")
+		case i == 0 && (c == ' ' || c == '#'):
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case i == len(v)-1 && c == ' ':
+			b.WriteString("\\ ")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// isHexString reports whether s is a non empty even length hex string
+func isHexString(s string) bool {
+	if len(s)%2 != 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isHex(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the RFC 4514 representation, least significant attribute (CN) first
+func (d DN) String() string {
+	parts := make([]string, 0, len(d))
+	for i := len(d) - 1; i >= 0; i-- {
+		parts = append(parts, d[i].Type+"="+escapeValue(d[i].Value))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Key returns the form used to compare identities: the canonical string with insignificant
+// whitespace removed and case folded, as DN attributes use case insensitive matching.
+func (d DN) Key() string {
+	normalized := make(DN, len(d))
+	for i, a := range d {
+		normalized[i] = Attribute{Type: a.Type, Value: strings.ToLower(strings.Join(strings.Fields(a.Value), " "))}
+	}
+	return normalized.String()
+}
+
+// Equal reports whether two DNs identify the same subject
+func (d DN) Equal(other DN) bool {
+	return d.Key() == other.Key()
+}
+
+// Get returns every value of an attribute type, in canonical order
+func (d DN) Get(t string) []string {
+	t = CanonicalType(t)
+	var values []string
+	for _, a := range d {
+		if a.Type == t {
+			values = append(values, a.Value)
+		}
+	}
+	return values
+}
+
+// Canonical parses a DN in any supported form and returns its canonical RFC 4514 string
+func Canonical(s string) (string, error) {
+	d, err := Parse(s)
+	if err != nil {
+		return "", err
+	}
+	return d.String(), nil
+}
@@ -0,0 +1,124 @@
+package dn
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"testing"
+)
+
+func TestFromName(t *testing.T) {
+	name := pkix.Name{
+		CommonName:         "Dimmadome Doug Test dtdimma",
+		Country:            []string{"US"},
+		Organization:       []string{"L.B. Cloud"},
+		OrganizationalUnit: []string{"CK8S", "People"},
+		Locality:           []string{"Dimmsdale"},
+		Province:           []string{"CA"},
+		SerialNumber:       "1234",
+		ExtraNames: []pkix.AttributeTypeAndValue{
+			{Type: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}, Value: "dtdimma@lootbot.cloud"},
+		},
+	}
+
+	expected := "EMAILADDRESS=dtdimma@lootbot.cloud,SERIALNUMBER=1234,CN=Dimmadome Doug Test dtdimma,OU=People,OU=CK8S,O=L.B. Cloud,L=Dimmsdale,ST=CA,C=US"
+	if got := FromName(name).String(); got != expected {
+		t.Errorf("Expected DN to be %s, got %s", expected, got)
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	d := DN{
+		{Type: "O", Value: "Acme, Inc."},
+		{Type: "OU", Value: "#hash"},
+		{Type: "CN", Value: " #lead+trail "},
+	}
+
+	expected := `CN=\ #lead\+trail\ ,OU=\#hash,O=Acme\, Inc.`
+	if got := d.String(); got != expected {
+		t.Errorf("Expected DN to be %s, got %s", expected, got)
+	}
+
+	// Parsing the escaped form must give back the original values
+	parsed, err := Parse(expected)
+	if err != nil {
+		t.Fatalf("Failed to parse DN: %v", err)
+	}
+	if parsed.Get("CN")[0] != " #lead+trail " || parsed.Get("O")[0] != "Acme, Inc." {
+		t.Errorf("Expected escaped values to round trip, got %#v", parsed)
+	}
+}
+
+func TestParseCanonicalizes(t *testing.T) {
+	inputs := []string{
+		"CN=test,OU=testOU,O=testO,C=US",
+		"c=US, o=testO, ou=testOU, cn=test",
+		"/C=US/O=testO/OU=testOU/CN=test",
+		"commonName=test+OU=testOU;2.5.4.10=testO;countryName=US",
+		`CN=\74est,OU=testOU,O=testO,C=US`,
+	}
+
+	for _, input := range inputs {
+		got, err := Canonical(input)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", input, err)
+			continue
+		}
+		if got != "CN=test,OU=testOU,O=testO,C=US" {
+			t.Errorf("Expected %q to canonicalize to CN=test,OU=testOU,O=testO,C=US, got %s", input, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, input := range []string{"", "wawrig2", "=value", `CN=test\`} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("Expected %q to fail to parse", input)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a, _ := Parse("CN=Test  User,O=Example,C=US")
+	b, _ := Parse("c=us,o=example,cn=test user")
+	c, _ := Parse("CN=Other User,O=Example,C=US")
+
+	if !a.Equal(b) {
+		t.Errorf("Expected %s to equal %s", a, b)
+	}
+	if a.Equal(c) {
+		t.Errorf("Expected %s not to equal %s", a, c)
+	}
+}
+
+func TestParseRoundTripsRepeatedTypes(t *testing.T) {
+	// Certificate order: most significant first
+	name := pkix.Name{Names: []pkix.AttributeTypeAndValue{
+		{Type: asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 25}, Value: "com"},
+		{Type: asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 25}, Value: "example"},
+		{Type: asn1.ObjectIdentifier{2, 5, 4, 11}, Value: "People"},
+		{Type: asn1.ObjectIdentifier{2, 5, 4, 11}, Value: "Army"},
+		{Type: asn1.ObjectIdentifier{2, 5, 4, 3}, Value: "Jane"},
+	}}
+	d := FromName(name)
+	if got := d.String(); got != "CN=Jane,OU=Army,OU=People,DC=example,DC=com" {
+		t.Fatalf("Unexpected DN %s", got)
+	}
+
+	for _, input := range []string{d.String(), "/DC=com/DC=example/OU=People/OU=Army/CN=Jane"} {
+		parsed, err := Parse(input)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", input, err)
+		}
+		if !parsed.Equal(d) || parsed.String() != d.String() {
+			t.Errorf("Expected %q to parse back to %s, got %s", input, d, parsed)
+		}
+	}
+
+	canonical, err := Canonical(d.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := Canonical(canonical); again != canonical {
+		t.Errorf("Expected Canonical to be idempotent, got %s then %s", canonical, again)
+	}
+}
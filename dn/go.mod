@@ -0,0 +1,3 @@
+module dn
+
+go 1.21
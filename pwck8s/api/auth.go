@@ -1,12 +1,29 @@
 package api
 
 import (
+	"crypto/x509"
+	"dn"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
+
+	"pwck8s/jwt"
 	x509toolkit "pwck8s/x509"
 )
 
-func GetUserDn(r *http.Request) (string, error) {
+// Authenticator resolves the DN of the user making a request
+type Authenticator interface {
+	Authenticate(r *http.Request) (string, error)
+}
+
+// HeaderAuthenticator trusts the DN set in a request header by an upstream proxy
+type HeaderAuthenticator struct {
+	// Header holding the user DN, defaults to UserDN
+	Header string
+}
+
+func (a HeaderAuthenticator) Authenticate(r *http.Request) (string, error) {
 
 	//Get the cert from the request
 	x509, err := x509toolkit.ParseCertificate(r, "X-Client-Certificate")
@@ -17,11 +34,164 @@ func GetUserDn(r *http.Request) (string, error) {
 		fmt.Printf("[X509] %v\n", x509toolkit.ParseDN(x509))
 	}
 
+	header := a.Header
+	if header == "" {
+		header = "UserDN"
+	}
+
 	// Get the UserDN from the request
-	// UserDN := r.Header.Get("X-Client-Dn")
-	UserDN := r.Header.Get("UserDN")
+	UserDN := r.Header.Get(header)
 	if UserDN == "" {
 		return "", fmt.Errorf("UserDN not found")
 	}
 	return UserDN, nil
 }
+
+// OIDCAuthenticator validates Keycloak (or any OIDC issuer) bearer tokens and reads the DN from a claim
+type OIDCAuthenticator struct {
+	// Issuer the token iss claim must match
+	Issuer string
+	// Audience the token aud claim must contain
+	Audience string
+	// DNClaim is the claim holding the user DN
+	DNClaim string
+	// Keys are the issuer's signing keys
+	Keys *jwt.KeySet
+	// Leeway allowed for clock skew when checking exp and nbf
+	Leeway time.Duration
+}
+
+func (a OIDCAuthenticator) Authenticate(r *http.Request) (string, error) {
+	// Get the bearer token from the request
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return "", fmt.Errorf("bearer token not found")
+	}
+	rawToken := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+
+	token, err := jwt.Parse(rawToken)
+	if err != nil {
+		return "", fmt.Errorf("invalid token: %v", err)
+	}
+
+	// Only accept asymmetric algorithms, a shared secret is never published in a JWKS
+	if strings.HasPrefix(token.Header.Algorithm, "HS") {
+		return "", fmt.Errorf("invalid token: unsupported algorithm %s", token.Header.Algorithm)
+	}
+
+	key, err := a.Keys.Key(token.Header.KeyID)
+	if err != nil {
+		return "", fmt.Errorf("invalid token: %v", err)
+	}
+	if err := token.Verify(key); err != nil {
+		return "", fmt.Errorf("invalid token: %v", err)
+	}
+	if err := token.Claims.Validate(a.Issuer, a.Audience, time.Now(), a.Leeway); err != nil {
+		return "", fmt.Errorf("invalid token: %v", err)
+	}
+
+	UserDN := token.Claims.String(a.DNClaim)
+	if UserDN == "" {
+		return "", fmt.Errorf("token has no %s claim", a.DNClaim)
+	}
+	return UserDN, nil
+}
+
+// AssertionAuthenticator only trusts identities signed by x509-proxy.
+// Requests reaching the backend directly, without a valid assertion, are rejected.
+type AssertionAuthenticator struct {
+	// Header holding the signed assertion
+	Header string
+	// Algorithm the assertion must be signed with
+	Algorithm string
+	// Key verifying the assertion, the shared secret or the proxy's public key
+	Key interface{}
+	// Issuer the assertion iss claim must match
+	Issuer string
+	// Audience the assertion aud claim must contain
+	Audience string
+	// Leeway allowed for clock skew when checking exp and nbf
+	Leeway time.Duration
+}
+
+func (a AssertionAuthenticator) Authenticate(r *http.Request) (string, error) {
+	rawToken := r.Header.Get(a.Header)
+	if rawToken == "" {
+		return "", fmt.Errorf("identity assertion not found")
+	}
+
+	token, err := jwt.Parse(rawToken)
+	if err != nil {
+		return "", fmt.Errorf("invalid identity assertion: %v", err)
+	}
+
+	// Pin the algorithm so a token can not pick how it is verified
+	if token.Header.Algorithm != a.Algorithm {
+		return "", fmt.Errorf("invalid identity assertion: unexpected algorithm %s", token.Header.Algorithm)
+	}
+	if err := token.Verify(a.Key); err != nil {
+		return "", fmt.Errorf("invalid identity assertion: %v", err)
+	}
+	if err := token.Claims.Validate(a.Issuer, a.Audience, time.Now(), a.Leeway); err != nil {
+		return "", fmt.Errorf("invalid identity assertion: %v", err)
+	}
+
+	UserDN := token.Claims.String("sub")
+	if UserDN == "" {
+		return "", fmt.Errorf("identity assertion has no subject")
+	}
+	return UserDN, nil
+}
+
+// CertificateAuthenticator derives the user DN from the client certificate forwarded by the proxy.
+// The certificate is verified against the configured CA pool on every request. A certificate is no secret,
+// so this is only safe when the backend can be reached through the proxy alone.
+type CertificateAuthenticator struct {
+	// Header holding the client certificate, see x509.ParseCertificate for the accepted encodings
+	Header string
+	// ChainHeader optionally holds the intermediate certificates between the client certificate and the CA bundle
+	ChainHeader string
+	// CAPool holds the trusted client CAs
+	CAPool *x509.CertPool
+}
+
+func (a CertificateAuthenticator) Authenticate(r *http.Request) (string, error) {
+	cert, err := x509toolkit.ParseCertificate(r, a.Header)
+	if err != nil {
+		return "", err
+	}
+
+	intermediates, err := x509toolkit.ParseCertificateChain(r, a.ChainHeader)
+	if err != nil {
+		return "", err
+	}
+
+	if err := x509toolkit.ValidateCACertificate(cert, a.CAPool, intermediates...); err != nil {
+		return "", err
+	}
+
+	UserDN := x509toolkit.ParseDN(cert)
+	if UserDN == "" {
+		return "", fmt.Errorf("client certificate has no subject")
+	}
+	return UserDN, nil
+}
+
+// GetUserDn authenticates the request with the configured Authenticator and returns the canonical user DN
+func GetUserDn(Config GlobalConfig, r *http.Request) (string, error) {
+	authenticator := Config.Authenticator
+	if authenticator == nil {
+		authenticator = HeaderAuthenticator{}
+	}
+	UserDN, err := authenticator.Authenticate(r)
+	if err != nil {
+		return "", err
+	}
+
+	// Use the canonical form as the identity key so every path yields the same identity.
+	// Values that are not DNs, such as a bare SID, are used as is.
+	if canonical, err := dn.Canonical(UserDN); err == nil {
+		return canonical, nil
+	}
+	return UserDN, nil
+}
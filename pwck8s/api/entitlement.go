@@ -0,0 +1,23 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// CheckEntitlement evaluates the entitlement policy for the user before any Rancher object is created.
+// It writes a 403 explaining which rule matched and returns false when the user is denied.
+func CheckEntitlement(Config GlobalConfig, w http.ResponseWriter, r *http.Request, UserDN string) bool {
+	// Without a policy everyone with a trusted identity is entitled
+	if Config.Policy == nil {
+		return true
+	}
+
+	decision := Config.Policy.Evaluate(UserDN)
+	if !decision.Allowed {
+		http.Error(w, Logboi(r, fmt.Sprintf("Forbidden: [%s] is not entitled to a sandbox: %s", UserDN, decision.Reason)), http.StatusForbidden)
+		return false
+	}
+	Logboi(r, fmt.Sprintf("Entitlement: [%s] %s", UserDN, decision.Reason))
+	return true
+}
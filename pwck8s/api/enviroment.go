@@ -21,7 +21,7 @@ func HandelEnvir(Config GlobalConfig, w http.ResponseWriter, r *http.Request) {
 	}
 
 	//Perform User Auth
-	UserDN, err := GetUserDn(r)
+	UserDN, err := GetUserDn(Config, r)
 	if err != nil {
 		http.Error(w, Logboi(r, err.Error()), http.StatusUnauthorized)
 		return
@@ -67,6 +67,11 @@ func HandleCleanupEnvir(Config GlobalConfig, UserDN string) error {
 }
 
 func handlePostEnvir(Config GlobalConfig, w http.ResponseWriter, r *http.Request, UserDN string) {
+	// Check the user is entitled to a sandbox before creating anything
+	if !CheckEntitlement(Config, w, r, UserDN) {
+		return
+	}
+
 	client := Config.Client
 
 	// Check if the user already has a project
@@ -2,6 +2,7 @@ package api
 
 import (
 	"net/http"
+	"pwck8s/policy"
 
 	"k8s.io/client-go/dynamic"
 )
@@ -13,6 +14,10 @@ type GlobalConfig struct {
 	DefaultProjectRole string
 	DefaultGlobalRole  string
 	Debug              bool
+	// Authenticator resolves the user DN for each request
+	Authenticator Authenticator
+	// Policy decides who may create a sandbox, nil allows everyone
+	Policy *policy.Store
 }
 
 // HandelCors sets the CORS headers for the response
@@ -58,9 +58,9 @@ func ProjectHandler(Config GlobalConfig, w http.ResponseWriter, r *http.Request)
 
 func HandleDeleteProject(Config GlobalConfig, w http.ResponseWriter, r *http.Request) {
 	// Get the UserDN from the request
-	UserDN := r.Header.Get("UserDN")
-	if UserDN == "" {
-		http.Error(w, Logboi(r, "UserDN not found"), http.StatusBadRequest)
+	UserDN, err := GetUserDn(Config, r)
+	if err != nil {
+		http.Error(w, Logboi(r, err.Error()), http.StatusUnauthorized)
 		return
 	}
 	client := Config.Client
@@ -86,13 +86,18 @@ func HandleDeleteProject(Config GlobalConfig, w http.ResponseWriter, r *http.Req
 func handlePostProject(Config GlobalConfig, w http.ResponseWriter, r *http.Request) {
 
 	// Get the UserDN from the request
-	UserDN := r.Header.Get("UserDN")
-	if UserDN == "" {
-		http.Error(w, Logboi(r, "UserDN not found"), http.StatusBadRequest)
+	UserDN, err := GetUserDn(Config, r)
+	if err != nil {
+		http.Error(w, Logboi(r, err.Error()), http.StatusUnauthorized)
 		return
 	}
 	client := Config.Client
 
+	// Check the user is entitled to a sandbox before creating anything
+	if !CheckEntitlement(Config, w, r, UserDN) {
+		return
+	}
+
 	//Get the User object from Rancher using the UserDN
 	user, err := rancher.GetRancherUser(client, UserDN)
 	if err != nil {
@@ -140,9 +145,9 @@ func handlePostProject(Config GlobalConfig, w http.ResponseWriter, r *http.Reque
 func handleGetProject(Config GlobalConfig, w http.ResponseWriter, r *http.Request) {
 
 	// Get the UserDN from the request
-	UserDN := r.Header.Get("UserDN")
-	if UserDN == "" {
-		http.Error(w, Logboi(r, "UserDN not found"), http.StatusBadRequest)
+	UserDN, err := GetUserDn(Config, r)
+	if err != nil {
+		http.Error(w, Logboi(r, err.Error()), http.StatusUnauthorized)
 		return
 	}
 	client := Config.Client
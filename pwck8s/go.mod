@@ -3,6 +3,7 @@ module pwck8s
 go 1.21
 
 require (
+	dn v0.0.0
 	github.com/fatih/color v1.16.0
 	k8s.io/apimachinery v0.28.3
 	k8s.io/client-go v0.28.3
@@ -50,3 +51,5 @@ require (
 	sigs.k8s.io/structured-merge-diff/v4 v4.2.3 // indirect
 	sigs.k8s.io/yaml v1.3.0 // indirect
 )
+
+replace dn => ../dn
@@ -0,0 +1,242 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jsonWebKey is a single entry of a JWKS document, only the fields needed for RSA and EC keys are decoded
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// KeySet caches the signing keys published by an OIDC issuer.
+// Keys are refreshed every RefreshInterval and whenever a token references an unknown key ID,
+// so issuer key rotation is picked up without a restart.
+type KeySet struct {
+	// Issuer is used to discover the JWKS endpoint when URL is empty
+	Issuer string
+	// URL of the JWKS document
+	URL string
+	// RefreshInterval is how long fetched keys are trusted before they are fetched again
+	RefreshInterval time.Duration
+	// MinRefreshInterval rate limits refetches triggered by unknown key IDs
+	MinRefreshInterval time.Duration
+	// Client used to fetch the discovery and JWKS documents
+	Client *http.Client
+
+	// mu guards the cached keys, refreshing is held by the one request fetching them
+	mu         sync.Mutex
+	refreshing sync.Mutex
+	keys       map[string]interface{}
+	fetched    time.Time
+	attempted  time.Time
+}
+
+// NewKeySet returns a KeySet for the given issuer, jwksURL may be empty to use OIDC discovery
+func NewKeySet(issuer string, jwksURL string, refreshInterval time.Duration) *KeySet {
+	return &KeySet{
+		Issuer:             issuer,
+		URL:                jwksURL,
+		RefreshInterval:    refreshInterval,
+		MinRefreshInterval: 30 * time.Second,
+		Client:             &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Key returns the public key with the given key ID.
+// Only one request fetches the keys at a time, the others keep using the cached keys meanwhile
+// and only wait for the fetch when they need a key that is not cached.
+func (k *KeySet) Key(kid string) (interface{}, error) {
+	key, found, due := k.cached(kid)
+	if due && k.lockRefresh(found) {
+		// Another request may have fetched the keys while this one waited
+		if key, found, due = k.cached(kid); due {
+			if err := k.refresh(); err != nil {
+				// Keep serving cached keys if the issuer is briefly unavailable
+				if !found {
+					k.refreshing.Unlock()
+					return nil, err
+				}
+				log.Printf("[KeySet] Error refreshing keys, using cached keys: %v", err)
+			}
+			key, found, _ = k.cached(kid)
+		}
+		k.refreshing.Unlock()
+	}
+	if !found {
+		return nil, fmt.Errorf("no signing key found for kid %q", kid)
+	}
+	return key, nil
+}
+
+// lockRefresh takes the refresh lock, without waiting for it when the key is already cached
+func (k *KeySet) lockRefresh(found bool) bool {
+	if found {
+		return k.refreshing.TryLock()
+	}
+	k.refreshing.Lock()
+	return true
+}
+
+// cached returns the cached key with the given ID, and whether the keys should be fetched again:
+// when they are stale or the key is unknown, at most once every MinRefreshInterval
+func (k *KeySet) cached(kid string) (interface{}, bool, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, found := k.lookup(kid)
+	due := (!found || time.Since(k.fetched) > k.RefreshInterval) && time.Since(k.attempted) > k.MinRefreshInterval
+	return key, found, due
+}
+
+// lookup finds a key by ID, a token without a kid matches when the set holds a single key
+func (k *KeySet) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, found := k.keys[kid]
+	return key, found
+}
+
+// refresh fetches the JWKS document and replaces the cached keys, the caller holds the refresh lock
+func (k *KeySet) refresh() error {
+	k.mu.Lock()
+	k.attempted = time.Now()
+	k.mu.Unlock()
+
+	if k.URL == "" {
+		jwksURL, err := k.discover()
+		if err != nil {
+			return err
+		}
+		k.URL = jwksURL
+	}
+
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := k.getJSON(k.URL, &document); err != nil {
+		return fmt.Errorf("error fetching JWKS: %v", err)
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range document.Keys {
+		// Skip encryption keys, only signature keys can verify tokens
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("[KeySet] Skipping key %q: %v", jwk.KeyID, err)
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("JWKS at %s contains no usable signing keys", k.URL)
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.fetched = time.Now()
+	k.mu.Unlock()
+	log.Printf("[KeySet] Loaded %d signing keys from %s", len(keys), k.URL)
+	return nil
+}
+
+// discover reads the jwks_uri from the issuer's OpenID configuration
+func (k *KeySet) discover() (string, error) {
+	if k.Issuer == "" {
+		return "", fmt.Errorf("either a JWKS URL or an issuer is required")
+	}
+	var configuration struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	discoveryURL := strings.TrimSuffix(k.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := k.getJSON(discoveryURL, &configuration); err != nil {
+		return "", fmt.Errorf("error fetching OpenID configuration: %v", err)
+	}
+	if configuration.JWKSURI == "" {
+		return "", fmt.Errorf("OpenID configuration at %s has no jwks_uri", discoveryURL)
+	}
+	return configuration.JWKSURI, nil
+}
+
+// getJSON fetches url and decodes the JSON response into v
+func (k *KeySet) getJSON(url string, v interface{}) error {
+	resp, err := k.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// publicKey converts a JWK into an *rsa.PublicKey or *ecdsa.PublicKey
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %v", err)
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %v", err)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %v", err)
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %v", err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.KeyType)
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
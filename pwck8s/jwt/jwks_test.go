@@ -0,0 +1,168 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ecJWK encodes an EC public key as a JWK
+func ecJWK(kid string, key *ecdsa.PublicKey) jsonWebKey {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return jsonWebKey{
+		KeyType: "EC",
+		KeyID:   kid,
+		Use:     "sig",
+		Curve:   key.Curve.Params().Name,
+		X:       base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+		Y:       base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+	}
+}
+
+// jwksServer serves the keys returned by keys and counts the fetches
+type jwksServer struct {
+	*httptest.Server
+	fetches atomic.Int32
+	mu      sync.Mutex
+	keys    []jsonWebKey
+}
+
+func newJWKSServer(t *testing.T, keys ...jsonWebKey) *jwksServer {
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": s.keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) setKeys(keys ...jsonWebKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func generateKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestKeySetUnknownKeyID(t *testing.T) {
+	first, second := generateKey(t), generateKey(t)
+	server := newJWKSServer(t, ecJWK("first", &first.PublicKey))
+	keys := NewKeySet("", server.URL, time.Hour)
+	keys.MinRefreshInterval = time.Hour
+
+	key, err := keys.Key("first")
+	if err != nil {
+		t.Fatalf("Failed to get key: %v", err)
+	}
+	if !key.(*ecdsa.PublicKey).Equal(&first.PublicKey) {
+		t.Error("Expected the published key")
+	}
+
+	// The issuer rotates its keys, tokens with the new kid must not refetch the keys on every request
+	server.setKeys(ecJWK("first", &first.PublicKey), ecJWK("second", &second.PublicKey))
+	for i := 0; i < 3; i++ {
+		if _, err := keys.Key("second"); err == nil {
+			t.Error("Expected the new key to be unknown until the keys may be fetched again")
+		}
+	}
+	if fetches := server.fetches.Load(); fetches != 1 {
+		t.Errorf("Expected unknown key IDs to be rate limited, the keys were fetched %d times", fetches)
+	}
+
+	keys.MinRefreshInterval = 0
+	if _, err := keys.Key("second"); err != nil {
+		t.Errorf("Expected the unknown key ID to fetch the keys again, got %v", err)
+	}
+	if _, err := keys.Key("first"); err != nil {
+		t.Errorf("Expected the cached key, got %v", err)
+	}
+	if fetches := server.fetches.Load(); fetches != 2 {
+		t.Errorf("Expected 2 fetches, got %d", fetches)
+	}
+}
+
+func TestKeySetServesCachedKeysWhileRefreshing(t *testing.T) {
+	key := generateKey(t)
+	release := make(chan struct{})
+	blocked := make(chan struct{})
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The second fetch hangs until released, like a slow issuer
+		if fetches.Add(1) == 2 {
+			close(blocked)
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{ecJWK("key", &key.PublicKey)}})
+	}))
+	defer server.Close()
+	defer close(release)
+
+	keys := NewKeySet("", server.URL, time.Hour)
+	keys.MinRefreshInterval = 0
+	if _, err := keys.Key("key"); err != nil {
+		t.Fatalf("Failed to get key: %v", err)
+	}
+
+	// Once stale, one request refreshes the keys, the others keep using the cached ones meanwhile
+	keys.RefreshInterval = 0
+	go keys.Key("key")
+	<-blocked
+	done := make(chan error)
+	go func() {
+		_, err := keys.Key("key")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected the cached key, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the cached key not to wait for the refresh")
+	}
+}
+
+func TestKeySetDiscovery(t *testing.T) {
+	key := generateKey(t)
+	var issuer string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/realms/pwck8s/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"jwks_uri": issuer + "/certs"})
+		case "/realms/pwck8s/certs":
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{
+				ecJWK("key", &key.PublicKey),
+				{KeyType: "RSA", KeyID: "encryption", Use: "enc"},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	issuer = server.URL + "/realms/pwck8s"
+
+	keys := NewKeySet(issuer+"/", "", time.Hour)
+	if _, err := keys.Key(""); err != nil {
+		t.Errorf("Expected a token without kid to use the only signing key, got %v", err)
+	}
+	if _, err := keys.Key("encryption"); err == nil {
+		t.Error("Expected encryption keys to be skipped")
+	}
+}
@@ -0,0 +1,243 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// Header is the JOSE header of a compact serialized JWT
+type Header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// Claims holds the decoded payload of a JWT
+type Claims map[string]interface{}
+
+// Token is a parsed but not yet verified JWT
+type Token struct {
+	Header    Header
+	Claims    Claims
+	signed    []byte
+	signature []byte
+}
+
+// Parse splits a compact serialized JWT into its header, claims and signature.
+// The signature is not checked, call Verify before trusting any claim.
+func Parse(raw string) (*Token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token: expected 3 parts, got %d", len(parts))
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding token header: %v", err)
+	}
+	var header Header
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("error parsing token header: %v", err)
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding token claims: %v", err)
+	}
+	var claims Claims
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return nil, fmt.Errorf("error parsing token claims: %v", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding token signature: %v", err)
+	}
+
+	return &Token{
+		Header:    header,
+		Claims:    claims,
+		signed:    []byte(parts[0] + "." + parts[1]),
+		signature: signature,
+	}, nil
+}
+
+// Verify checks the token signature with the given key.
+// The key must be an *rsa.PublicKey, *ecdsa.PublicKey or an HMAC secret ([]byte) matching the token algorithm.
+func (t *Token) Verify(key interface{}) error {
+	hash, err := hashForAlgorithm(t.Header.Algorithm)
+	if err != nil {
+		return err
+	}
+	h := hash.New()
+	h.Write(t.signed)
+	digest := h.Sum(nil)
+
+	switch t.Header.Algorithm[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s requires an RSA public key", t.Header.Algorithm)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, hash, digest, t.signature); err != nil {
+			return fmt.Errorf("invalid token signature: %v", err)
+		}
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s requires an RSA public key", t.Header.Algorithm)
+		}
+		if err := rsa.VerifyPSS(pub, hash, digest, t.signature, nil); err != nil {
+			return fmt.Errorf("invalid token signature: %v", err)
+		}
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s requires an ECDSA public key", t.Header.Algorithm)
+		}
+		// Each ES algorithm is bound to one curve
+		if curve := ecdsaCurves[t.Header.Algorithm]; pub.Curve.Params().Name != curve {
+			return fmt.Errorf("algorithm %s requires a %s key", t.Header.Algorithm, curve)
+		}
+		// JWS encodes ECDSA signatures as the fixed size concatenation R || S
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(t.signature) != 2*size {
+			return fmt.Errorf("invalid token signature length")
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return fmt.Errorf("algorithm %s requires a shared secret", t.Header.Algorithm)
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write(t.signed)
+		if !hmac.Equal(mac.Sum(nil), t.signature) {
+			return fmt.Errorf("invalid token signature")
+		}
+	}
+	return nil
+}
+
+// ecdsaCurves are the curves of the ES algorithms
+var ecdsaCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+// hashForAlgorithm returns the digest used by a supported JWS algorithm
+func hashForAlgorithm(alg string) (crypto.Hash, error) {
+	switch alg {
+	case "RS256", "PS256", "ES256", "HS256":
+		return crypto.SHA256, nil
+	case "RS384", "PS384", "ES384", "HS384":
+		return crypto.SHA384, nil
+	case "RS512", "PS512", "ES512", "HS512":
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported token algorithm: %q", alg)
+}
+
+// String returns the string value of a claim, or "" if it is missing or not a string
+func (c Claims) String(name string) string {
+	value, _ := c[name].(string)
+	return value
+}
+
+// Time returns a NumericDate claim as a time.Time
+func (c Claims) Time(name string) (time.Time, bool) {
+	value, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+// HasAudience reports whether the aud claim, a string or a list of strings, contains audience
+func (c Claims) HasAudience(audience string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Validate checks the registered iss, aud, exp and nbf claims.
+// An empty issuer or audience skips that check, leeway allows for clock skew.
+func (c Claims) Validate(issuer string, audience string, now time.Time, leeway time.Duration) error {
+	if issuer != "" && c.String("iss") != issuer {
+		return fmt.Errorf("unexpected token issuer: %q", c.String("iss"))
+	}
+	if audience != "" && !c.HasAudience(audience) {
+		return fmt.Errorf("token audience does not include %q", audience)
+	}
+
+	// Tokens without an expiry are never accepted
+	exp, ok := c.Time("exp")
+	if !ok {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now.After(exp.Add(leeway)) {
+		return fmt.Errorf("token expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+
+	if nbf, ok := c.Time("nbf"); ok && now.Add(leeway).Before(nbf) {
+		return fmt.Errorf("token not valid before %s", nbf.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// LoadVerificationKey reads the key used to verify tokens signed with algorithm.
+// HS algorithms read the shared secret as is, RS, PS and ES algorithms read a PEM public key or certificate.
+func LoadVerificationKey(algorithm string, path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read verification key: %v", err)
+	}
+
+	if strings.HasPrefix(algorithm, "HS") {
+		return []byte(strings.TrimSpace(string(data))), nil
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse verification key PEM")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("unsupported verification key type %q", block.Type)
+}
@@ -0,0 +1,190 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+// encodeToken serializes a header and claims, sign returns the signature of the signing input
+func encodeToken(t *testing.T, header Header, claims Claims, sign func(signed []byte) []byte) string {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+// signHMAC signs with HMAC-SHA256
+func signHMAC(secret []byte) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+// signRSA signs with RSASSA-PKCS1-v1_5 and SHA-256
+func signRSA(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+}
+
+// signECDSA signs a SHA-256 digest and encodes the signature as R || S sized for the key's curve
+func signECDSA(t *testing.T, key *ecdsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+		return signature
+	}
+}
+
+func parse(t *testing.T, raw string) *Token {
+	token, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+	return token
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The public key is no secret, a token MACed with it must not pass as one signed with the private key
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	claims := Claims{"sub": "CN=jane"}
+
+	tests := []struct {
+		name  string
+		token string
+		key   interface{}
+		valid bool
+	}{
+		{"RS256", encodeToken(t, Header{Algorithm: "RS256"}, claims, signRSA(t, rsaKey)), &rsaKey.PublicKey, true},
+		{"ES256", encodeToken(t, Header{Algorithm: "ES256"}, claims, signECDSA(t, p256Key)), &p256Key.PublicKey, true},
+		{"HS256", encodeToken(t, Header{Algorithm: "HS256"}, claims, signHMAC([]byte("secret"))), []byte("secret"), true},
+		{"none", encodeToken(t, Header{Algorithm: "none"}, claims, func([]byte) []byte { return nil }), &rsaKey.PublicKey, false},
+		{"None", encodeToken(t, Header{Algorithm: "None"}, claims, func([]byte) []byte { return nil }), []byte("secret"), false},
+		{"HS256 with an RSA key", encodeToken(t, Header{Algorithm: "HS256"}, claims, signHMAC(publicPEM)), &rsaKey.PublicKey, false},
+		{"RS256 with a secret", encodeToken(t, Header{Algorithm: "RS256"}, claims, signRSA(t, rsaKey)), publicPEM, false},
+		{"ES256 with an RSA key", encodeToken(t, Header{Algorithm: "ES256"}, claims, signECDSA(t, p256Key)), &rsaKey.PublicKey, false},
+		{"ES256 on P-384", encodeToken(t, Header{Algorithm: "ES256"}, claims, signECDSA(t, p384Key)), &p384Key.PublicKey, false},
+		{"ES384 on P-256", encodeToken(t, Header{Algorithm: "ES384"}, claims, signECDSA(t, p256Key)), &p256Key.PublicKey, false},
+		{"wrong secret", encodeToken(t, Header{Algorithm: "HS256"}, claims, signHMAC([]byte("other"))), []byte("secret"), false},
+	}
+	for _, test := range tests {
+		err := parse(t, test.token).Verify(test.key)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, err)
+		}
+	}
+
+	// A signature made over other claims does not verify
+	token := encodeToken(t, Header{Algorithm: "HS256"}, claims, signHMAC([]byte("secret")))
+	forged := encodeToken(t, Header{Algorithm: "HS256"}, Claims{"sub": "CN=admin"}, signHMAC([]byte("secret")))
+	parts := strings.Split(forged, ".")
+	if err := parse(t, parts[0]+"."+parts[1]+"."+strings.Split(token, ".")[2]).Verify([]byte("secret")); err == nil {
+		t.Error("Expected a signature of other claims to be rejected")
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, raw := range []string{"", "a.b", "a.b.c.d", "!.e30.", "e30.!.", "e30.e30.!"} {
+		if _, err := Parse(raw); err == nil {
+			t.Errorf("Expected %q to be rejected", raw)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Now()
+	valid := func() Claims {
+		return Claims{
+			"iss": "https://keycloak.example.com/realms/pwck8s",
+			"aud": []interface{}{"account", "pwck8s"},
+			"exp": float64(now.Add(time.Hour).Unix()),
+			"nbf": float64(now.Add(-time.Minute).Unix()),
+		}
+	}
+	with := func(name string, value interface{}) Claims {
+		claims := valid()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name   string
+		claims Claims
+		valid  bool
+	}{
+		{"valid", valid(), true},
+		{"audience string", with("aud", "pwck8s"), true},
+		{"expired", with("exp", float64(now.Add(-time.Minute).Unix())), false},
+		{"expired within leeway", with("exp", float64(now.Add(-10*time.Second).Unix())), true},
+		{"no expiry", with("exp", nil), false},
+		{"not yet valid", with("nbf", float64(now.Add(time.Minute).Unix())), false},
+		{"not yet valid within leeway", with("nbf", float64(now.Add(10*time.Second).Unix())), true},
+		{"wrong issuer", with("iss", "https://evil.example.com/realms/pwck8s"), false},
+		{"no issuer", with("iss", nil), false},
+		{"wrong audience", with("aud", []interface{}{"account"}), false},
+		{"no audience", with("aud", nil), false},
+	}
+	for _, test := range tests {
+		err := test.claims.Validate("https://keycloak.example.com/realms/pwck8s", "pwck8s", now, 30*time.Second)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, err)
+		}
+	}
+
+	// Empty issuer and audience skip their checks
+	if err := with("iss", nil).Validate("", "", now, 0); err != nil {
+		t.Errorf("Expected no issuer and audience checks, got %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
@@ -8,9 +10,14 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"net/http"
 	"pwck8s/api"
+	"pwck8s/jwt"
+	"pwck8s/policy"
+	"pwck8s/rancher"
+	x509toolkit "pwck8s/x509"
 
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
@@ -89,15 +96,217 @@ func GetConfigFromEnv() (api.GlobalConfig, error) {
 	Config.DefaultProjectRole = DefaultProjectRole
 	Config.DefaultGlobalRole = DefaultGlobalRole
 
+	// Get the authenticator
+	Authenticator, err := GetAuthenticatorFromEnv()
+	if err != nil {
+		return Config, err
+	}
+	Config.Authenticator = Authenticator
+
+	// Get the entitlement policy, everyone is entitled when it is not set
+	if PolicyPath := os.Getenv("ENTITLEMENT_POLICY"); PolicyPath != "" {
+		Policy, err := policy.NewStore(PolicyPath)
+		if err != nil {
+			return Config, fmt.Errorf("error loading ENTITLEMENT_POLICY: %v", err)
+		}
+
+		// Reload the policy when the mounted ConfigMap changes
+		RefreshInterval := 30 * time.Second
+		if value := os.Getenv("ENTITLEMENT_POLICY_REFRESH"); value != "" {
+			RefreshInterval, err = time.ParseDuration(value)
+			if err != nil {
+				return Config, fmt.Errorf("invalid ENTITLEMENT_POLICY_REFRESH: %v", err)
+			}
+		}
+		go Policy.Watch(RefreshInterval, nil)
+		Config.Policy = Policy
+	}
+
 	return Config, nil
 
 }
 
+// GetAuthenticatorFromEnv builds the request authenticator selected by AUTH_MODE.
+// "header" (the default) trusts the UserDN header, "oidc" validates Keycloak bearer tokens
+// "assertion" only accepts identities signed by x509-proxy and "certificate" verifies the forwarded client certificate.
+func GetAuthenticatorFromEnv() (api.Authenticator, error) {
+	AuthMode := os.Getenv("AUTH_MODE")
+	if AuthMode == "" {
+		AuthMode = "header"
+	}
+
+	switch AuthMode {
+	case "header":
+		return api.HeaderAuthenticator{Header: os.Getenv("AUTH_HEADER")}, nil
+
+	case "oidc":
+		Issuer := os.Getenv("OIDC_ISSUER_URL")
+		if Issuer == "" {
+			return nil, errors.New("OIDC_ISSUER_URL not set")
+		}
+
+		Audience := os.Getenv("OIDC_AUDIENCE")
+		if Audience == "" {
+			return nil, errors.New("OIDC_AUDIENCE not set")
+		}
+
+		DNClaim := os.Getenv("OIDC_DN_CLAIM")
+		if DNClaim == "" {
+			DNClaim = "dn"
+		}
+
+		// How often the JWKS is refetched, unknown key IDs also trigger a refetch
+		RefreshInterval := time.Hour
+		if value := os.Getenv("OIDC_JWKS_REFRESH"); value != "" {
+			interval, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid OIDC_JWKS_REFRESH: %v", err)
+			}
+			RefreshInterval = interval
+		}
+
+		return api.OIDCAuthenticator{
+			Issuer:   Issuer,
+			Audience: Audience,
+			DNClaim:  DNClaim,
+			Keys:     jwt.NewKeySet(Issuer, os.Getenv("OIDC_JWKS_URL"), RefreshInterval),
+			Leeway:   30 * time.Second,
+		}, nil
+
+	case "assertion":
+		KeyPath := os.Getenv("ASSERTION_KEY")
+		if KeyPath == "" {
+			return nil, errors.New("ASSERTION_KEY not set")
+		}
+
+		Algorithm := os.Getenv("ASSERTION_ALG")
+		if Algorithm == "" {
+			Algorithm = "HS256"
+		}
+
+		Header := os.Getenv("ASSERTION_HEADER")
+		if Header == "" {
+			Header = "X-Identity-Assertion"
+		}
+
+		Issuer := os.Getenv("ASSERTION_ISSUER")
+		if Issuer == "" {
+			Issuer = "x509-proxy"
+		}
+
+		Audience := os.Getenv("ASSERTION_AUDIENCE")
+		if Audience == "" {
+			Audience = "pwck8s"
+		}
+
+		Key, err := jwt.LoadVerificationKey(Algorithm, KeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		return api.AssertionAuthenticator{
+			Header:    Header,
+			Algorithm: Algorithm,
+			Key:       Key,
+			Issuer:    Issuer,
+			Audience:  Audience,
+			Leeway:    5 * time.Second,
+		}, nil
+
+	case "certificate":
+		CABundlePath := os.Getenv("CERT_CA_BUNDLE")
+		if CABundlePath == "" {
+			return nil, errors.New("CERT_CA_BUNDLE not set")
+		}
+
+		CABundle, err := os.ReadFile(CABundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CERT_CA_BUNDLE: %v", err)
+		}
+		// The pool is built once, not for every request
+		CAPool, err := x509toolkit.LoadCAPool(CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CERT_CA_BUNDLE: %v", err)
+		}
+
+		Header := os.Getenv("CERT_HEADER")
+		if Header == "" {
+			Header = "X-Client-Certificate"
+		}
+
+		return api.CertificateAuthenticator{
+			Header:      Header,
+			ChainHeader: os.Getenv("CERT_CHAIN_HEADER"),
+			CAPool:      CAPool,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown AUTH_MODE %q", AuthMode)
+}
+
+// GetServerTLSConfigFromEnv returns the TLS config of the API server, nil to serve plain HTTP.
+// With TLS_CLIENT_CA every connection must present a client certificate from that CA, so only
+// x509-proxy can reach the API and direct traffic inside the cluster is refused.
+func GetServerTLSConfigFromEnv() (*tls.Config, error) {
+	CertPath := os.Getenv("TLS_CERT")
+	KeyPath := os.Getenv("TLS_KEY")
+	if CertPath == "" && KeyPath == "" {
+		return nil, nil
+	}
+	if CertPath == "" || KeyPath == "" {
+		return nil, errors.New("TLS_CERT and TLS_KEY must be set together")
+	}
+
+	Certificate, err := tls.LoadX509KeyPair(CertPath, KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading TLS_CERT and TLS_KEY: %v", err)
+	}
+	TLSConfig := &tls.Config{
+		Certificates: []tls.Certificate{Certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	ClientCAPath := os.Getenv("TLS_CLIENT_CA")
+	if ClientCAPath == "" {
+		return TLSConfig, nil
+	}
+	ClientCA, err := os.ReadFile(ClientCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading TLS_CLIENT_CA: %v", err)
+	}
+	TLSConfig.ClientCAs = x509.NewCertPool()
+	if !TLSConfig.ClientCAs.AppendCertsFromPEM(ClientCA) {
+		return nil, errors.New("TLS_CLIENT_CA contains no PEM certificates")
+	}
+	TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	// Optionally only accept the proxy's own certificate, not every certificate of the CA
+	var ClientNames []string
+	for _, name := range strings.Split(os.Getenv("TLS_CLIENT_NAMES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			ClientNames = append(ClientNames, name)
+		}
+	}
+	if len(ClientNames) > 0 {
+		TLSConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			leaf := state.PeerCertificates[0]
+			for _, name := range ClientNames {
+				if leaf.Subject.CommonName == name || leaf.VerifyHostname(name) == nil {
+					return nil
+				}
+			}
+			return fmt.Errorf("client certificate %q is not allowed", leaf.Subject.CommonName)
+		}
+	}
+	return TLSConfig, nil
+}
+
 // main function initializes a Kubernetes clientset and dynamic client, fetches Kubernetes version info,
 // gets the config from the environment, sets up HTTP server and handlers, and starts the server on port 8080.
 func main() {
 	var kubeconfig *string
 	debug := flag.Bool("debug", false, "Set to true to use kubeconfig for local debugging")
+	migrateLabels := flag.Bool("migrate-labels", false, "Rewrite DN labels of existing objects to identity hashes and exit")
 
 	if home := homedir.HomeDir(); home != "" {
 		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
@@ -163,6 +372,16 @@ func main() {
 	GlobalConfig.Client = dynamicClient
 	GlobalConfig.Debug = *debug
 
+	// Run the one-off label migration instead of serving requests
+	if *migrateLabels {
+		if err := rancher.MigrateIdentityLabels(dynamicClient, GlobalConfig.ClusterID); err != nil {
+			color.Red("Error migrating identity labels: %v", err)
+			os.Exit(1)
+		}
+		color.Green("Identity labels migrated")
+		return
+	}
+
 	// Setup HTTP server and handlers
 	http.HandleFunc("/api/v1/project", func(w http.ResponseWriter, r *http.Request) {
 		api.ProjectHandler(GlobalConfig, w, r)
@@ -176,7 +395,18 @@ func main() {
 		api.HealthCheckHandler(w, r)
 	})
 
+	TLSConfig, err := GetServerTLSConfigFromEnv()
+	if err != nil {
+		color.Red("Error getting TLS config from environment: %v", err)
+		return
+	}
+
 	// Start the server on port 8080
+	if TLSConfig != nil {
+		log.Println("Starting TLS server on :8080")
+		server := &http.Server{Addr: ":8080", TLSConfig: TLSConfig}
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
 	log.Println("Starting server on :8080")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
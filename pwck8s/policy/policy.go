@@ -0,0 +1,235 @@
+package policy
+
+import (
+	"bytes"
+	"dn"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// Rule matches users by attributes of their DN. Every condition that is set must match.
+type Rule struct {
+	// Name identifies the rule in denials and logs
+	Name string `json:"name"`
+	// Effect is allow or deny
+	Effect string `json:"effect"`
+	// OU matches when any OU of the DN is in the list
+	OU []string `json:"ou,omitempty"`
+	// O matches when any O of the DN is in the list
+	O []string `json:"o,omitempty"`
+	// CNRegex matches the CN of the DN
+	CNRegex string `json:"cnRegex,omitempty"`
+	// DNRegex matches the full canonical DN
+	DNRegex string `json:"dnRegex,omitempty"`
+
+	cnRegex *regexp.Regexp
+	dnRegex *regexp.Regexp
+}
+
+// Policy is the entitlement policy deciding who may create a sandbox.
+// Deny rules take precedence over allow rules, DefaultEffect applies when no rule matches.
+type Policy struct {
+	DefaultEffect string `json:"defaultEffect"`
+	Rules         []Rule `json:"rules"`
+}
+
+// Decision is the outcome of evaluating a Policy for a user
+type Decision struct {
+	Allowed bool
+	// Rule is the name of the matching rule, empty when the default applied
+	Rule   string
+	Reason string
+}
+
+// Parse reads a JSON policy and compiles its rules
+func Parse(data []byte) (*Policy, error) {
+	var p Policy
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p); err != nil {
+		return nil, fmt.Errorf("error parsing policy: %v", err)
+	}
+
+	// Deny anyone not explicitly allowed unless told otherwise
+	if p.DefaultEffect == "" {
+		p.DefaultEffect = EffectDeny
+	}
+	if p.DefaultEffect != EffectAllow && p.DefaultEffect != EffectDeny {
+		return nil, fmt.Errorf("invalid defaultEffect %q", p.DefaultEffect)
+	}
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if rule.Effect != EffectAllow && rule.Effect != EffectDeny {
+			return nil, fmt.Errorf("rule %s: invalid effect %q", rule.Name, rule.Effect)
+		}
+		if len(rule.OU) == 0 && len(rule.O) == 0 && rule.CNRegex == "" && rule.DNRegex == "" {
+			return nil, fmt.Errorf("rule %s: no conditions", rule.Name)
+		}
+		var err error
+		if rule.CNRegex != "" {
+			if rule.cnRegex, err = regexp.Compile(rule.CNRegex); err != nil {
+				return nil, fmt.Errorf("rule %s: invalid cnRegex: %v", rule.Name, err)
+			}
+		}
+		if rule.DNRegex != "" {
+			if rule.dnRegex, err = regexp.Compile(rule.DNRegex); err != nil {
+				return nil, fmt.Errorf("rule %s: invalid dnRegex: %v", rule.Name, err)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// matches reports whether every condition of the rule matches the user
+func (rule Rule) matches(UserDN string, parsed dn.DN) bool {
+	if len(rule.OU) > 0 && !containsAny(rule.OU, parsed.Get("OU")) {
+		return false
+	}
+	if len(rule.O) > 0 && !containsAny(rule.O, parsed.Get("O")) {
+		return false
+	}
+	if rule.cnRegex != nil {
+		cns := parsed.Get("CN")
+		if len(cns) == 0 || !rule.cnRegex.MatchString(cns[0]) {
+			return false
+		}
+	}
+	if rule.dnRegex != nil && !rule.dnRegex.MatchString(UserDN) {
+		return false
+	}
+	return true
+}
+
+// matchesAttributes reports whether the rule has conditions on attributes of the DN
+func (rule Rule) matchesAttributes() bool {
+	return len(rule.OU) > 0 || len(rule.O) > 0 || rule.cnRegex != nil
+}
+
+// containsAny reports whether any value is in the list, ignoring case
+func containsAny(list []string, values []string) bool {
+	for _, value := range values {
+		for _, item := range list {
+			if strings.EqualFold(item, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Evaluate decides whether the user may create a sandbox
+func (p *Policy) Evaluate(UserDN string) Decision {
+	// An identity that is not a DN, such as a bare SID or user name, has none of the attributes deny rules
+	// look for. It is denied as soon as a rule matches attributes, otherwise only dnRegex rules can match it.
+	parsed, err := dn.Parse(UserDN)
+	if err != nil || len(parsed) == 0 {
+		for _, rule := range p.Rules {
+			if rule.matchesAttributes() {
+				return Decision{Allowed: false, Reason: "identity is not a DN, rules on DN attributes can not be checked"}
+			}
+		}
+	}
+
+	// Deny rules win over allow rules
+	for _, rule := range p.Rules {
+		if rule.Effect == EffectDeny && rule.matches(UserDN, parsed) {
+			return Decision{Allowed: false, Rule: rule.Name, Reason: fmt.Sprintf("denied by rule %q", rule.Name)}
+		}
+	}
+	for _, rule := range p.Rules {
+		if rule.Effect == EffectAllow && rule.matches(UserDN, parsed) {
+			return Decision{Allowed: true, Rule: rule.Name, Reason: fmt.Sprintf("allowed by rule %q", rule.Name)}
+		}
+	}
+
+	if p.DefaultEffect == EffectAllow {
+		return Decision{Allowed: true, Reason: "allowed by default"}
+	}
+	return Decision{Allowed: false, Reason: "no allow rule matched"}
+}
+
+// Store holds the current policy and reloads it when the file changes.
+// A ConfigMap mounted as a volume is updated in place by the kubelet, so edits apply without a restart.
+type Store struct {
+	Path string
+
+	mu      sync.RWMutex
+	policy  *Policy
+	content []byte
+}
+
+// NewStore loads the policy at path, failing if it is missing or invalid
+func NewStore(path string) (*Store, error) {
+	s := &Store{Path: path}
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the policy file again and reports whether it changed.
+// An invalid policy is rejected and the previous policy stays in effect.
+func (s *Store) Reload() (bool, error) {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return false, fmt.Errorf("error reading policy: %v", err)
+	}
+
+	s.mu.RLock()
+	unchanged := bytes.Equal(data, s.content)
+	s.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	p, err := Parse(data)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	s.policy = p
+	s.content = data
+	s.mu.Unlock()
+	log.Printf("[Policy] Loaded %d entitlement rules from %s (default %s)", len(p.Rules), s.Path, p.DefaultEffect)
+	return true, nil
+}
+
+// Watch reloads the policy every interval until stop is closed
+func (s *Store) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := s.Reload(); err != nil {
+				log.Printf("[Policy] Keeping previous policy: %v", err)
+			}
+		}
+	}
+}
+
+// Evaluate decides with the current policy
+func (s *Store) Evaluate(UserDN string) Decision {
+	s.mu.RLock()
+	p := s.policy
+	s.mu.RUnlock()
+	return p.Evaluate(UserDN)
+}
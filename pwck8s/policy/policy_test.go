@@ -0,0 +1,123 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mustParse(t *testing.T, data string) *Policy {
+	p, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+	return p
+}
+
+func TestEvaluate(t *testing.T) {
+	rules := `"rules": [
+		{"name": "ck8s-users", "effect": "allow", "ou": ["CK8S"], "o": ["L.B. Cloud"]},
+		{"name": "contractors", "effect": "deny", "ou": ["Contractors"]},
+		{"name": "no-service-accounts", "effect": "deny", "cnRegex": "(?i)^svc[-_]"},
+		{"name": "admins", "effect": "allow", "dnRegex": "^CN=admin,"}
+	]`
+	deny := mustParse(t, `{"defaultEffect": "deny", `+rules+`}`)
+	allow := mustParse(t, `{"defaultEffect": "allow", `+rules+`}`)
+	// Without DN attribute rules, identities that are not DNs are matched as plain strings
+	regexOnly := mustParse(t, `{"rules": [{"name": "sids", "effect": "allow", "dnRegex": "^S-1-5-21-"}]}`)
+
+	tests := []struct {
+		name     string
+		policy   *Policy
+		identity string
+		allowed  bool
+		rule     string
+	}{
+		{"allowed", deny, "CN=Jane Doe,OU=CK8S,O=L.B. Cloud,C=US", true, "ck8s-users"},
+		{"attributes ignore case", deny, "cn=Jane Doe,ou=ck8s,o=l.b. cloud,c=US", true, "ck8s-users"},
+		{"slash form", deny, "/C=US/O=L.B. Cloud/OU=CK8S/CN=Jane Doe", true, "ck8s-users"},
+		{"one of several OUs", deny, "CN=Jane Doe,OU=PKI,OU=CK8S,O=L.B. Cloud,C=US", true, "ck8s-users"},
+		{"every condition must match", deny, "CN=Jane Doe,OU=CK8S,O=Other,C=US", false, ""},
+		{"deny wins over allow", deny, "CN=Jane Doe,OU=CK8S,OU=Contractors,O=L.B. Cloud,C=US", false, "contractors"},
+		{"deny by CN", deny, "CN=svc-backup,OU=CK8S,O=L.B. Cloud,C=US", false, "no-service-accounts"},
+		{"allow by DN", deny, "CN=admin,O=Other", true, "admins"},
+		{"default deny", deny, "CN=Jane Doe,OU=Sales,O=Other,C=US", false, ""},
+		{"default allow", allow, "CN=Jane Doe,OU=Sales,O=Other,C=US", true, ""},
+		{"default allow keeps deny rules", allow, "CN=Jane Doe,OU=Contractors,O=Other,C=US", false, "contractors"},
+		{"SID with default deny", deny, "S-1-5-21-3623811015-3361044348-30300820-1013", false, ""},
+		{"SID with default allow", allow, "S-1-5-21-3623811015-3361044348-30300820-1013", false, ""},
+		{"user name with default allow", allow, "jdoe", false, ""},
+		{"invalid DN matching an allow rule", deny, "CN=admin,jdoe", false, ""},
+		{"empty identity", allow, "", false, ""},
+		{"SID matching a regex only policy", regexOnly, "S-1-5-21-3623811015-3361044348-30300820-1013", true, "sids"},
+		{"user name with a regex only policy", regexOnly, "jdoe", false, ""},
+	}
+	for _, test := range tests {
+		decision := test.policy.Evaluate(test.identity)
+		if decision.Allowed != test.allowed || decision.Rule != test.rule {
+			t.Errorf("%s: expected allowed %v by rule %q, got %+v", test.name, test.allowed, test.rule, decision)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	p := mustParse(t, `{"rules": [{"effect": "allow", "ou": ["CK8S"]}]}`)
+	if p.DefaultEffect != EffectDeny {
+		t.Errorf("Expected the default effect to be deny, got %s", p.DefaultEffect)
+	}
+	if p.Rules[0].Name != "rule-0" {
+		t.Errorf("Expected a generated rule name, got %s", p.Rules[0].Name)
+	}
+
+	for _, invalid := range []string{
+		`{"defaultEffect": "maybe", "rules": []}`,
+		`{"rules": [{"effect": "permit", "ou": ["CK8S"]}]}`,
+		`{"rules": [{"effect": "allow"}]}`,
+		`{"rules": [{"effect": "allow", "cnRegex": "("}]}`,
+		`{"rules": [{"effect": "allow", "dnRegex": "("}]}`,
+		`{"rules": [{"effect": "allow", "organization": ["CK8S"]}]}`,
+		`{"rules": [`,
+	} {
+		if _, err := Parse([]byte(invalid)); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(`{"defaultEffect": "deny", "rules": [{"effect": "allow", "ou": ["CK8S"]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	if !store.Evaluate("CN=Jane Doe,OU=CK8S").Allowed {
+		t.Error("Expected the loaded policy to allow CK8S")
+	}
+
+	// An invalid policy keeps the previous one in effect
+	if err := os.WriteFile(path, []byte(`{"defaultEffect": "maybe"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Reload(); err == nil {
+		t.Error("Expected the invalid policy to be rejected")
+	}
+	if !store.Evaluate("CN=Jane Doe,OU=CK8S").Allowed {
+		t.Error("Expected the previous policy to stay in effect")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"defaultEffect": "deny", "rules": [{"effect": "allow", "ou": ["Sales"]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := store.Reload(); !changed || err != nil {
+		t.Fatalf("Expected the policy to change, got %v", err)
+	}
+	if store.Evaluate("CN=Jane Doe,OU=CK8S").Allowed {
+		t.Error("Expected the new policy to apply")
+	}
+	if changed, _ := store.Reload(); changed {
+		t.Error("Expected an unchanged file not to be reloaded")
+	}
+}
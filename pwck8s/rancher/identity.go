@@ -0,0 +1,36 @@
+package rancher
+
+import (
+	"crypto/sha256"
+	"dn"
+	"encoding/hex"
+)
+
+// Label and annotation keys identifying the owner of the objects we create.
+// Labels hold the IdentityKey so they can be used in selectors, annotations hold the full DN.
+const (
+	OwnerDNKey     = "pwck8s/ownerdn"
+	UserDNKey      = "pwck8s/userdn"
+	DisplayNameKey = "pwck8s/displayname"
+)
+
+// IdentityKey returns a stable, label-safe hash of the canonical DN.
+// Real certificate DNs contain spaces, commas and = and are often longer than 63 characters,
+// none of which is allowed in a label value. A SHA-224 hex digest is 56 characters.
+func IdentityKey(UserDN string) string {
+	key := UserDN
+	if parsed, err := dn.Parse(UserDN); err == nil {
+		key = parsed.Key()
+	}
+	sum := sha256.Sum224([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// identityAnnotation reads the full DN from an annotation, falling back to the label
+// for objects created before the DN moved out of the labels.
+func identityAnnotation(annotations map[string]string, labels map[string]string, key string) string {
+	if value, ok := annotations[key]; ok {
+		return value
+	}
+	return labels[key]
+}
@@ -0,0 +1,47 @@
+package rancher
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestIdentityKey(t *testing.T) {
+	const canonical = "CN=Doe\\, Jane,OU=CK8S,O=L.B. Cloud,C=US"
+	key := IdentityKey(canonical)
+
+	// Every form of the same DN must select the same objects
+	for _, equal := range []string{
+		"c=US, o=L.B. Cloud, ou=CK8S, cn=Doe\\, Jane",
+		"CN=doe\\, jane,OU=ck8s,O=l.b. cloud,C=us",
+		"CN=Doe\\2C Jane,OU=CK8S,O=L.B. Cloud,C=US",
+		"CN=Doe\\,  Jane,OU=CK8S,O=L.B.  Cloud,C=US",
+		"commonName=Doe\\, Jane,organizationalUnitName=CK8S,2.5.4.10=L.B. Cloud,countryName=US",
+	} {
+		if got := IdentityKey(equal); got != key {
+			t.Errorf("Expected %q to have the key of %q, got %s and %s", equal, canonical, got, key)
+		}
+	}
+
+	for _, other := range []string{
+		"CN=Doe\\, John,OU=CK8S,O=L.B. Cloud,C=US",
+		"CN=Doe\\, Jane,OU=Contractors,O=L.B. Cloud,C=US",
+		"OU=CK8S,O=L.B. Cloud,C=US",
+	} {
+		if IdentityKey(other) == key {
+			t.Errorf("Expected %q to have another key than %q", other, canonical)
+		}
+	}
+
+	// Long DNs and identities that are not DNs must fit in a label too
+	long := "CN=A Very Long Common Name Of Someone,OU=Department Of Things That Need Long Names,OU=CK8S,O=L.B. Cloud,C=US"
+	for _, identity := range []string{canonical, long, "S-1-5-21-3623811015-3361044348-30300820-1013", "jdoe", ""} {
+		value := IdentityKey(identity)
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			t.Errorf("Expected the key of %q to be a valid label value, got %v", identity, errs)
+		}
+		if len(value) != 56 {
+			t.Errorf("Expected a 56 character key for %q, got %d", identity, len(value))
+		}
+	}
+}
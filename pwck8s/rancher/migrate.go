@@ -0,0 +1,87 @@
+package rancher
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// MigrateIdentityLabels rewrites objects created while the raw DN was stored in the
+// pwck8s/ownerdn and pwck8s/userdn labels. The DN is moved to an annotation and the label
+// is replaced by its IdentityKey, so GetRancherUser, GetProjectsByOwner and GetGlobalRoleBinding find them again.
+// Objects that were already migrated are left untouched, so it is safe to run more than once.
+func MigrateIdentityLabels(client dynamic.Interface, ClusterID string) error {
+	resources := []struct {
+		gvr       schema.GroupVersionResource
+		namespace string
+	}{
+		{schema.GroupVersionResource{Group: "management.cattle.io", Version: "v3", Resource: "users"}, ""},
+		{schema.GroupVersionResource{Group: "management.cattle.io", Version: "v3", Resource: "globalrolebindings"}, ""},
+		{schema.GroupVersionResource{Group: "management.cattle.io", Version: "v3", Resource: "projects"}, ClusterID},
+		{schema.GroupVersionResource{Group: "management.cattle.io", Version: "v3", Resource: "projectroletemplatebindings"}, ClusterID},
+	}
+
+	for _, resource := range resources {
+		// Only objects created by pwck8s carry the ownerdn label
+		listOptions := v1.ListOptions{LabelSelector: OwnerDNKey}
+		list, err := client.Resource(resource.gvr).Namespace(resource.namespace).List(context.TODO(), listOptions)
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %v", resource.gvr.Resource, err)
+		}
+
+		migrated := 0
+		for _, item := range list.Items {
+			if !migrateIdentity(&item) {
+				continue
+			}
+			_, err := client.Resource(resource.gvr).Namespace(resource.namespace).Update(context.TODO(), &item, v1.UpdateOptions{})
+			if err != nil {
+				return fmt.Errorf("failed to update %s %s: %v", resource.gvr.Resource, item.GetName(), err)
+			}
+			migrated++
+		}
+		fmt.Printf("[MigrateIdentityLabels] Migrated %d of %d %s\n", migrated, len(list.Items), resource.gvr.Resource)
+	}
+	return nil
+}
+
+// migrateIdentity moves the DN labels of a single object to annotations and reports whether it changed
+func migrateIdentity(item *unstructured.Unstructured) bool {
+	labels := item.GetLabels()
+	annotations := item.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	changed := false
+	for _, key := range []string{OwnerDNKey, UserDNKey} {
+		value, ok := labels[key]
+		if !ok {
+			continue
+		}
+		// Already migrated when the annotation holds the DN the label is the hash of
+		if UserDN, ok := annotations[key]; ok && IdentityKey(UserDN) == value {
+			continue
+		}
+		annotations[key] = value
+		labels[key] = IdentityKey(value)
+		changed = true
+	}
+
+	// Projects also used the DN as their display name label
+	if value, ok := labels[DisplayNameKey]; ok {
+		annotations[DisplayNameKey] = value
+		delete(labels, DisplayNameKey)
+		changed = true
+	}
+
+	if changed {
+		item.SetLabels(labels)
+		item.SetAnnotations(annotations)
+	}
+	return changed
+}
@@ -0,0 +1,96 @@
+package rancher
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// labeledObject is an object with the given labels and annotations, nil maps are left unset
+func labeledObject(labels map[string]string, annotations map[string]string) *unstructured.Unstructured {
+	item := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	item.SetName("u-abc12")
+	if labels != nil {
+		item.SetLabels(labels)
+	}
+	if annotations != nil {
+		item.SetAnnotations(annotations)
+	}
+	return item
+}
+
+func TestMigrateIdentity(t *testing.T) {
+	const userDN = "CN=jdoe,OU=CK8S,O=LB,C=US"
+	key := IdentityKey(userDN)
+
+	tests := []struct {
+		name                string
+		labels              map[string]string
+		annotations         map[string]string
+		changed             bool
+		expectedLabels      map[string]string
+		expectedAnnotations map[string]string
+	}{
+		{
+			name:                "legacy user",
+			labels:              map[string]string{OwnerDNKey: userDN, UserDNKey: userDN, "other": "kept"},
+			changed:             true,
+			expectedLabels:      map[string]string{OwnerDNKey: key, UserDNKey: key, "other": "kept"},
+			expectedAnnotations: map[string]string{OwnerDNKey: userDN, UserDNKey: userDN},
+		},
+		{
+			name:                "legacy project",
+			labels:              map[string]string{OwnerDNKey: userDN, DisplayNameKey: userDN},
+			annotations:         map[string]string{"field.cattle.io/creatorId": "u-abc12"},
+			changed:             true,
+			expectedLabels:      map[string]string{OwnerDNKey: key},
+			expectedAnnotations: map[string]string{OwnerDNKey: userDN, DisplayNameKey: userDN, "field.cattle.io/creatorId": "u-abc12"},
+		},
+		{
+			name:                "migrated",
+			labels:              map[string]string{OwnerDNKey: key, UserDNKey: key},
+			annotations:         map[string]string{OwnerDNKey: userDN, UserDNKey: userDN},
+			changed:             false,
+			expectedLabels:      map[string]string{OwnerDNKey: key, UserDNKey: key},
+			expectedAnnotations: map[string]string{OwnerDNKey: userDN, UserDNKey: userDN},
+		},
+		{
+			name:                "migrated with another form of the DN",
+			labels:              map[string]string{OwnerDNKey: key},
+			annotations:         map[string]string{OwnerDNKey: "/C=US/O=LB/OU=CK8S/CN=jdoe"},
+			changed:             false,
+			expectedLabels:      map[string]string{OwnerDNKey: key},
+			expectedAnnotations: map[string]string{OwnerDNKey: "/C=US/O=LB/OU=CK8S/CN=jdoe"},
+		},
+		{
+			name:           "not ours",
+			labels:         map[string]string{"other": "kept"},
+			changed:        false,
+			expectedLabels: map[string]string{"other": "kept"},
+		},
+	}
+	for _, test := range tests {
+		item := labeledObject(test.labels, test.annotations)
+		if changed := migrateIdentity(item); changed != test.changed {
+			t.Errorf("%s: expected changed %v, got %v", test.name, test.changed, changed)
+		}
+		if labels := item.GetLabels(); !reflect.DeepEqual(labels, test.expectedLabels) {
+			t.Errorf("%s: expected labels %v, got %v", test.name, test.expectedLabels, labels)
+		}
+		if annotations := item.GetAnnotations(); len(annotations) > 0 || len(test.expectedAnnotations) > 0 {
+			if !reflect.DeepEqual(annotations, test.expectedAnnotations) {
+				t.Errorf("%s: expected annotations %v, got %v", test.name, test.expectedAnnotations, annotations)
+			}
+		}
+
+		// Running the migration again leaves the object as it is
+		migrated := item.DeepCopy()
+		if migrateIdentity(item) {
+			t.Errorf("%s: expected a second migration not to change the object", test.name)
+		}
+		if !reflect.DeepEqual(item, migrated) {
+			t.Errorf("%s: expected a second migration to leave %v, got %v", test.name, migrated.Object, item.Object)
+		}
+	}
+}
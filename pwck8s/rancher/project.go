@@ -67,10 +67,10 @@ func MapToProject(tmpProject unstructured.Unstructured) (Project, error) {
 
 	project.DisplayName = DisplayName
 
-	// Extract data using unstructured getters
-	OwnerDN, found, err := unstructured.NestedString(tmpProject.Object, "metadata", "labels", "pwck8s/ownerdn")
-	if err != nil || !found {
-		return project, fmt.Errorf("ownerdn not found or error in reading: %v", err)
+	// The full DN lives in an annotation, the label only holds its hash
+	OwnerDN := identityAnnotation(tmpProject.GetAnnotations(), tmpProject.GetLabels(), OwnerDNKey)
+	if OwnerDN == "" {
+		return project, fmt.Errorf("ownerdn not found")
 	}
 	project.OwnerDN = OwnerDN
 
@@ -286,13 +286,17 @@ func CreateRancherProject(client dynamic.Interface, newProject Project) error {
 			"metadata": map[string]interface{}{
 				"name": newProject.ProjectID,
 				"labels": map[string]string{
-					"pwck8s/ownerdn":        newProject.OwnerDN, // Add the label with the user's DN
-					"pwck8s/displayname":    newProject.DisplayName,
+					OwnerDNKey:              IdentityKey(newProject.OwnerDN), // Add the label with the hash of the user's DN
 					"pwck8s/projectid":      newProject.ProjectID,
 					"pwck8s/clusterid":      newProject.ClusterID,
 					"pwck8s/creationtime":   newProject.CreationTime.Format("2006-01-02T15-04-05Z07-00"),
 					"pwck8s/expirationtime": newProject.ExpirationTime.Format("2006-01-02T15-04-05Z07-00"),
 				},
+				// The DN and display name are not label-safe, keep them in annotations
+				"annotations": map[string]string{
+					OwnerDNKey:     newProject.OwnerDN,
+					DisplayNameKey: newProject.DisplayName,
+				},
 			},
 			"spec": projectSpec,
 		},
@@ -324,7 +328,7 @@ func GetProjectsByOwner(client dynamic.Interface, OwnerDN string, ClusterID stri
 		Resource: "projects",
 	}
 
-	labelSelector := labels.Set(map[string]string{"pwck8s/ownerdn": OwnerDN}).AsSelector().String()
+	labelSelector := labels.Set(map[string]string{OwnerDNKey: IdentityKey(OwnerDN)}).AsSelector().String()
 	listOptions := v1.ListOptions{LabelSelector: labelSelector}
 	projectList, err := client.Resource(projectGVR).Namespace(ClusterID).List(context.TODO(), listOptions)
 	if err != nil {
@@ -342,7 +346,7 @@ func GetProjectByOwner(client dynamic.Interface, OwnerDN string, ClusterID strin
 		Resource: "projects",
 	}
 
-	labelSelector := labels.Set(map[string]string{"pwck8s/ownerdn": OwnerDN}).AsSelector().String()
+	labelSelector := labels.Set(map[string]string{OwnerDNKey: IdentityKey(OwnerDN)}).AsSelector().String()
 	listOptions := v1.ListOptions{LabelSelector: labelSelector}
 	projectList, err := client.Resource(projectGVR).Namespace(ClusterID).List(context.TODO(), listOptions)
 	if err != nil {
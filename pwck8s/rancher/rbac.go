@@ -28,11 +28,15 @@ func CreateGlobalRoleBinding(client dynamic.Interface, newUser User, globalRoleN
 				"name": newUser.UserID,
 				"labels": map[string]string{
 					"pwck8s/userid":         newUser.UserID,
-					"pwck8s/userdn":         newUser.UserDN,
-					"pwck8s/ownerdn":        newUser.UserDN,
+					UserDNKey:               IdentityKey(newUser.UserDN),
+					OwnerDNKey:              IdentityKey(newUser.UserDN),
 					"pwck8s/creationtime":   newUser.CreationTime.Format("2006-01-02T15-04-05Z07-00"),
 					"pwck8s/expirationtime": newUser.ExpirationTime.Format("2006-01-02T15-04-05Z07-00"),
 				},
+				"annotations": map[string]string{
+					UserDNKey:  newUser.UserDN,
+					OwnerDNKey: newUser.UserDN,
+				},
 			},
 			"globalRoleName": globalRoleName,
 			"userName":       newUser.UserID,
@@ -79,7 +83,7 @@ func GetGlobalRoleBinding(client dynamic.Interface, OwnerDN string) (string, err
 		Resource: "globalrolebindings",
 	}
 
-	labelSelector := labels.Set(map[string]string{"pwck8s/ownerdn": OwnerDN}).AsSelector().String()
+	labelSelector := labels.Set(map[string]string{OwnerDNKey: IdentityKey(OwnerDN)}).AsSelector().String()
 	listOptions := v1.ListOptions{LabelSelector: labelSelector}
 	// Get the user in Rancher
 	userList, err := client.Resource(grbGVR).Namespace("").List(context.TODO(), listOptions)
@@ -116,11 +120,15 @@ func CreateProjectRoleBinding(client dynamic.Interface, UserID string, project P
 				"name": "pwck8s-project-owner",
 				"labels": map[string]string{
 					"pwck8s/userid":         UserID,
-					"pwck8s/userdn":         project.OwnerDN,
-					"pwck8s/ownerdn":        project.OwnerDN,
+					UserDNKey:               IdentityKey(project.OwnerDN),
+					OwnerDNKey:              IdentityKey(project.OwnerDN),
 					"pwck8s/creationtime":   project.CreationTime.Format("2006-01-02T15-04-05Z07-00"),
 					"pwck8s/expirationtime": project.ExpirationTime.Format("2006-01-02T15-04-05Z07-00"),
 				},
+				"annotations": map[string]string{
+					UserDNKey:  project.OwnerDN,
+					OwnerDNKey: project.OwnerDN,
+				},
 			},
 			"projectName":       project.ClusterID + ":" + project.ProjectID,
 			"roleTemplateName":  projectRoleName,
@@ -66,11 +66,15 @@ func CreateRancherUser(client dynamic.Interface, newUser User) error {
 				"name": newUser.UserID,
 				"labels": map[string]string{
 					"pwck8s/userid":         newUser.UserID,
-					"pwck8s/userdn":         newUser.UserDN,
-					"pwck8s/ownerdn":        newUser.UserDN,
+					UserDNKey:               IdentityKey(newUser.UserDN),
+					OwnerDNKey:              IdentityKey(newUser.UserDN),
 					"pwck8s/creationtime":   newUser.CreationTime.Format("2006-01-02T15-04-05Z07-00"),
 					"pwck8s/expirationtime": newUser.ExpirationTime.Format("2006-01-02T15-04-05Z07-00"),
 				},
+				"annotations": map[string]string{
+					UserDNKey:  newUser.UserDN,
+					OwnerDNKey: newUser.UserDN,
+				},
 			},
 			"principalIds": newUser.PrincipalIds,
 			"description":  "Created by pwck8s",
@@ -121,7 +125,7 @@ func GetRancherUser(client dynamic.Interface, OwnerDN string) (User, error) {
 		Resource: "users",
 	}
 
-	labelSelector := labels.Set(map[string]string{"pwck8s/ownerdn": OwnerDN}).AsSelector().String()
+	labelSelector := labels.Set(map[string]string{OwnerDNKey: IdentityKey(OwnerDN)}).AsSelector().String()
 	listOptions := v1.ListOptions{LabelSelector: labelSelector}
 	// Get the user in Rancher
 	userList, err := client.Resource(userGVR).Namespace("").List(context.TODO(), listOptions)
@@ -147,7 +151,7 @@ func GetRancherUser(client dynamic.Interface, OwnerDN string) (User, error) {
 		DisplayName: user.Object["username"].(string),
 		// PrincipalIds:   user.Object["principalIds"].([]interface{}([]string)),
 		PrincipalIds:   []string{"local://" + user.Object["metadata"].(map[string]interface{})["name"].(string)},
-		UserDN:         user.Object["metadata"].(map[string]interface{})["labels"].(map[string]interface{})["pwck8s/userdn"].(string),
+		UserDN:         identityAnnotation(user.GetAnnotations(), user.GetLabels(), UserDNKey),
 		CreationTime:   CreationTime,
 		ExpirationTime: ExpirationTime,
 	}
@@ -164,7 +168,7 @@ func UserExists(client dynamic.Interface, OwnerDN string) (bool, error) {
 		Resource: "users",
 	}
 
-	labelSelector := labels.Set(map[string]string{"pwck8s/ownerdn": OwnerDN}).AsSelector().String()
+	labelSelector := labels.Set(map[string]string{OwnerDNKey: IdentityKey(OwnerDN)}).AsSelector().String()
 	listOptions := v1.ListOptions{LabelSelector: labelSelector}
 	// Get the user in Rancher
 	userList, err := client.Resource(userGVR).Namespace("").List(context.TODO(), listOptions)
@@ -1,14 +1,20 @@
 package x509
 
 import (
+	"bytes"
 	"crypto/x509"
+	"dn"
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
-// ParseCertificate extracts a client certificate from HTTP headers and returns the parsed certificate
+// ParseCertificate extracts a client certificate from HTTP headers and returns the parsed certificate.
+// The header may hold base64 encoded PEM, URL-escaped PEM (as sent by nginx) or base64 encoded DER.
 func ParseCertificate(r *http.Request, HttpCertHeader string) (*x509.Certificate, error) {
 	// Check if the header is set
 	if HttpCertHeader == "" {
@@ -20,46 +26,112 @@ func ParseCertificate(r *http.Request, HttpCertHeader string) (*x509.Certificate
 		return nil, fmt.Errorf("no client certificate found in header")
 	}
 
-	// Decode the base64-encoded certificate
-	decodedCert, err := base64.StdEncoding.DecodeString(certHeader)
+	certs, err := decodeCertificates(certHeader)
 	if err != nil {
-		return nil, fmt.Errorf("error decoding certificate: %v", err)
+		return nil, err
 	}
+	return certs[0], nil
+}
 
-	// Parse the PEM encoded certificate
-	block, _ := pem.Decode(decodedCert)
-	if block == nil {
-		return nil, fmt.Errorf("failed to parse certificate PEM")
+// ParseCertificateChain extracts the intermediate certificates forwarded next to the client certificate.
+// A missing header is not an error, the chain is simply empty.
+func ParseCertificateChain(r *http.Request, HttpChainHeader string) ([]*x509.Certificate, error) {
+	if HttpChainHeader == "" {
+		return nil, nil
+	}
+	chainHeader := r.Header.Get(HttpChainHeader)
+	if chainHeader == "" {
+		return nil, nil
 	}
+	return decodeCertificates(chainHeader)
+}
 
-	// Parse the certificate
-	cert, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+// decodeCertificates decodes one or more certificates from a header value in any supported encoding
+func decodeCertificates(value string) ([]*x509.Certificate, error) {
+	var data []byte
+	if strings.HasPrefix(value, "-----") || strings.HasPrefix(value, "%2D") {
+		// URL-escaped PEM, '-' and '%' never appear in base64. A '+' of the base64 body may be left
+		// unescaped, so it is not decoded as a space like in a query string.
+		unescaped, err := url.PathUnescape(value)
+		if err != nil {
+			return nil, fmt.Errorf("error unescaping certificate: %v", err)
+		}
+		data = []byte(unescaped)
+	} else {
+		// Decode the base64-encoded certificate
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding certificate: %v", err)
+		}
+		data = decoded
 	}
 
-	return cert, nil
-}
+	// Base64 without a PEM block is DER, possibly several certificates concatenated
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		certs, err := x509.ParseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %v", err)
+		}
+		if len(certs) == 0 {
+			return nil, fmt.Errorf("no certificate found in header")
+		}
+		return certs, nil
+	}
 
-// ValidateCACertificate validates a client certificate (*x509.Certificate) against the given CA certificate in PEM format
-func ValidateCACertificate(clientCert *x509.Certificate, caCertPEM []byte) error {
-	// Decode the CA certificate
-	caBlock, _ := pem.Decode(caCertPEM)
-	if caBlock == nil {
-		return fmt.Errorf("failed to parse CA certificate PEM")
-	}
-	caCert, err := x509.ParseCertificate(caBlock.Bytes)
-	if err != nil {
-		return fmt.Errorf("failed to parse CA certificate: %v", err)
+	// Parse every PEM encoded certificate
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %v", err)
+		}
+		certs = append(certs, cert)
 	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("failed to parse certificate PEM")
+	}
+	return certs, nil
+}
 
-	// Create a new CertPool and add the CA certificate to it
+// LoadCAPool reads a PEM bundle of one or more CA certificates into a pool
+func LoadCAPool(caCertPEM []byte) (*x509.CertPool, error) {
 	caCertPool := x509.NewCertPool()
-	caCertPool.AddCert(caCert)
+	if !caCertPool.AppendCertsFromPEM(caCertPEM) {
+		return nil, fmt.Errorf("failed to parse CA certificate PEM")
+	}
+	return caCertPool, nil
+}
 
-	// Verify the client certificate against the CA certificate
+// ValidateCACertificate validates a client certificate (*x509.Certificate) against a pool of CA certificates.
+// The client certificate must be currently valid, chain to one of them, optionally through the given
+// intermediates, and be issued for client authentication.
+func ValidateCACertificate(clientCert *x509.Certificate, caCertPool *x509.CertPool, intermediates ...*x509.Certificate) error {
+	// Check the validity dates first to give a clearer error than the chain verification
+	now := time.Now()
+	if now.Before(clientCert.NotBefore) {
+		return fmt.Errorf("client certificate is not valid before %s", clientCert.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if now.After(clientCert.NotAfter) {
+		return fmt.Errorf("client certificate expired at %s", clientCert.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	// Verify the client certificate against the CA certificates
 	opts := x509.VerifyOptions{
-		Roots: caCertPool,
+		Roots:         caCertPool,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, intermediate := range intermediates {
+		opts.Intermediates.AddCert(intermediate)
 	}
 
 	if _, err := clientCert.Verify(opts); err != nil {
@@ -69,42 +141,10 @@ func ValidateCACertificate(clientCert *x509.Certificate, caCertPEM []byte) error
 	return nil
 }
 
-// ParseDN returns the Distinguished Name (DN) of the given x509.Certificate
+// ParseDN returns the canonical RFC 4514 Distinguished Name (DN) of the given x509.Certificate
 func ParseDN(cert *x509.Certificate) string {
 	if cert == nil {
 		return ""
 	}
-
-	var dnParts []string
-
-	if len(cert.Subject.CommonName) > 0 {
-		dnParts = append(dnParts, fmt.Sprintf("CN=%s", cert.Subject.CommonName))
-	}
-	for _, org := range cert.Subject.Organization {
-		dnParts = append(dnParts, fmt.Sprintf("O=%s", org))
-	}
-	for _, country := range cert.Subject.Country {
-		dnParts = append(dnParts, fmt.Sprintf("C=%s", country))
-	}
-	// Add other components as needed, such as OrganizationalUnit, Locality, etc.
-
-	return fmt.Sprintf("/%s", stringJoin(dnParts, "/"))
+	return dn.FromCertificate(cert).String()
 }
-
-// stringJoin is a helper function to join strings with a separator
-func stringJoin(parts []string, sep string) string {
-	if len(parts) == 0 {
-		return ""
-	}
-	result := parts[0]
-	for _, part := range parts[1:] {
-		result += sep + part
-	}
-	return result
-}
-
-
-
-
-
-
@@ -0,0 +1,131 @@
+package x509
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// issue signs a certificate from template for a new key, self-signed when parent is nil
+func issue(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	if template.SerialNumber == nil {
+		template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	}
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// issueCA creates a CA certificate, signed by parent or self-signed when parent is nil
+func issueCA(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	return issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, parent, parentKey)
+}
+
+func TestValidateCACertificate(t *testing.T) {
+	root, rootKey := issueCA(t, "root", nil, nil)
+	intermediate, intermediateKey := issueCA(t, "intermediate", root, rootKey)
+	other, otherKey := issueCA(t, "other", nil, nil)
+
+	pool, err := LoadCAPool(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}))
+	if err != nil {
+		t.Fatalf("Failed to load CA pool: %v", err)
+	}
+	if _, err := LoadCAPool([]byte("not a certificate")); err == nil {
+		t.Error("Expected a bundle without certificates to be rejected")
+	}
+
+	client := func(parent *x509.Certificate, parentKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage, notAfter time.Time) *x509.Certificate {
+		cert, _ := issue(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "jane"},
+			ExtKeyUsage: []x509.ExtKeyUsage{usage},
+			NotBefore:   time.Now().Add(-2 * time.Hour),
+			NotAfter:    notAfter,
+		}, parent, parentKey)
+		return cert
+	}
+	valid := time.Now().Add(time.Hour)
+	expired := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name          string
+		cert          *x509.Certificate
+		intermediates []*x509.Certificate
+		valid         bool
+	}{
+		{"root", client(root, rootKey, x509.ExtKeyUsageClientAuth, valid), nil, true},
+		{"intermediate", client(intermediate, intermediateKey, x509.ExtKeyUsageClientAuth, valid), []*x509.Certificate{intermediate}, true},
+		{"missing intermediate", client(intermediate, intermediateKey, x509.ExtKeyUsageClientAuth, valid), nil, false},
+		{"other CA", client(other, otherKey, x509.ExtKeyUsageClientAuth, valid), nil, false},
+		{"server usage", client(root, rootKey, x509.ExtKeyUsageServerAuth, valid), nil, false},
+		{"expired", client(root, rootKey, x509.ExtKeyUsageClientAuth, expired), nil, false},
+	}
+	for _, test := range tests {
+		err := ValidateCACertificate(test.cert, pool, test.intermediates...)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, err)
+		}
+	}
+}
+
+func TestParseCertificateEncodings(t *testing.T) {
+	// Issue certificates until the base64 of one contains a '+', which a query unescape would turn into a space
+	var cert *x509.Certificate
+	var certPEM string
+	for i := 0; i < 100 && !strings.Contains(certPEM, "+"); i++ {
+		cert, _ = issueCA(t, "jane", nil, nil)
+		certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	}
+	if !strings.Contains(certPEM, "+") {
+		t.Fatal("Failed to issue a certificate with a '+' in its PEM")
+	}
+
+	for name, value := range map[string]string{
+		"base64 PEM":               base64.StdEncoding.EncodeToString([]byte(certPEM)),
+		"base64 DER":               base64.StdEncoding.EncodeToString(cert.Raw),
+		"URL-escaped PEM":          strings.ReplaceAll(url.QueryEscape(certPEM), "+", "%20"),
+		"URL-escaped PEM with '+'": url.PathEscape(certPEM),
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Client-Certificate", value)
+		parsed, err := ParseCertificate(req, "")
+		if err != nil {
+			t.Errorf("%s: failed to parse certificate: %v", name, err)
+			continue
+		}
+		if !parsed.Equal(cert) {
+			t.Errorf("%s: expected the issued certificate", name)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"dn"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Log formats
+const (
+	LogFormatJSON   = "json"
+	LogFormatLogfmt = "logfmt"
+)
+
+// RequestIDHeader carries the request ID to the upstream and back to the client
+const RequestIDHeader = "X-Request-Id"
+
+// NewLogger returns a structured logger writing the given format to w
+func NewLogger(format string, w io.Writer) (*slog.Logger, error) {
+	switch format {
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, nil)), nil
+	case LogFormatLogfmt:
+		return slog.New(slog.NewTextHandler(w, nil)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected %s or %s", format, LogFormatJSON, LogFormatLogfmt)
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// useLogger makes logger the default of slog. With color the standard logger keeps writing its ANSI coloured
+// lines as they are, otherwise it writes through logger too, whose handlers would escape the colours.
+func useLogger(logger *slog.Logger, color bool) {
+	output, flags := log.Writer(), log.Flags()
+	slog.SetDefault(logger)
+	if color {
+		log.SetOutput(output)
+		log.SetFlags(flags)
+		return
+	}
+	colorRed, colorGreen, colorYellow, colorBlue, colorPurple, colorCyan, colorWhite, colorReset = "", "", "", "", "", "", "", ""
+}
+
+// requestInfo collects what the handlers learn about a request for its access log entry
+type requestInfo struct {
+	ID       string
+	Route    string
+	Upstream string
+	// Certificate is the client certificate passed through by a trusted ingress
+	Certificate *x509.Certificate
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFrom returns the request's access log information, nil outside of AccessLog
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// newRequestID returns a random 128 bit request ID
+func newRequestID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// statusRecorder records the status and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	// Informational responses such as 100 Continue are followed by the real status, except for an upgrade
+	if s.status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush and hijack the underlying connection
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// AccessLog logs one entry per request with the client identity, upstream, status, size and duration,
+// and counts it in metrics when not nil.
+// Every request gets a new ID, sent to the upstream and back to the client in X-Request-Id.
+func AccessLog(logger *slog.Logger, metrics *ProxyMetrics, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// Never trust a request ID from the client, it would let it forge log correlation
+		info := &requestInfo{ID: newRequestID()}
+		r.Header.Set(RequestIDHeader, info.ID)
+		w.Header().Set(RequestIDHeader, info.ID)
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		aborted := true
+		defer func() {
+			// A stream cut short by a timeout or a closed connection aborts the handler with a panic,
+			// it is logged too and the panic goes on to the server
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			if metrics != nil {
+				metrics.ObserveRequest(info.Route, recorder.status)
+			}
+
+			attrs := []slog.Attr{
+				slog.String("request_id", info.ID),
+				slog.String("remote_addr", r.RemoteAddr),
+				slog.String("method", r.Method),
+				slog.String("host", r.Host),
+				slog.String("path", r.URL.Path),
+				slog.String("proto", r.Proto),
+			}
+			// A certificate passed through by the ingress replaces the one of the ingress's own handshake
+			cert := info.Certificate
+			if cert == nil && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+				cert = r.TLS.PeerCertificates[0]
+			}
+			if cert != nil {
+				attrs = append(attrs, slog.String("dn", dn.FromCertificate(cert).String()))
+				if cert.SerialNumber != nil {
+					attrs = append(attrs, slog.String("serial", cert.SerialNumber.Text(16)))
+				}
+			}
+			attrs = append(attrs,
+				slog.String("route", info.Route),
+				slog.String("upstream", info.Upstream),
+				slog.Int("status", recorder.status),
+				slog.Int64("bytes", recorder.bytes),
+				slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			)
+			if aborted {
+				attrs = append(attrs, slog.Bool("aborted", true))
+			}
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "access", attrs...)
+		}()
+		next.ServeHTTP(recorder, r)
+		aborted = false
+	})
+}
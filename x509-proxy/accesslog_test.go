@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"log"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var upstreamRequestID string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequestID = r.Header.Get(RequestIDHeader)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "created")
+	}))
+	defer upstream.Close()
+
+	router, err := NewRouter([]Route{{Name: "api", Prefix: "/api/", Upstream: upstream.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	logger, err := NewLogger(LogFormatJSON, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "http://example.com/api/users", nil)
+	req.Header.Set(RequestIDHeader, "forged")
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "test", Organization: []string{"testO"}}, SerialNumber: big.NewInt(255)}},
+	}
+	rr := httptest.NewRecorder()
+	AccessLog(logger, nil, router).ServeHTTP(rr, req)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a JSON access log, got %q: %v", out.String(), err)
+	}
+	expected := map[string]interface{}{
+		"msg":    "access",
+		"method": "POST",
+		"path":   "/api/users",
+		"dn":     "CN=test,O=testO",
+		"serial": "ff",
+		"route":  "api",
+		"status": float64(http.StatusCreated),
+		"bytes":  float64(len("created")),
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("Expected %s to be %v, got %v", key, value, entry[key])
+		}
+	}
+	if _, found := entry["duration_ms"]; !found {
+		t.Error("Expected the duration to be logged")
+	}
+	if !strings.HasPrefix(upstream.URL, "http://"+entry["upstream"].(string)) {
+		t.Errorf("Expected the upstream host, got %v", entry["upstream"])
+	}
+
+	// The client's request ID is replaced by ours, which reaches the upstream and the client
+	requestID := entry["request_id"]
+	if requestID == "forged" || len(upstreamRequestID) != 32 {
+		t.Errorf("Expected a new request ID, got %v", requestID)
+	}
+	if upstreamRequestID != requestID || rr.Header().Get(RequestIDHeader) != requestID {
+		t.Errorf("Expected request ID %v upstream and in the response, got %s and %s", requestID, upstreamRequestID, rr.Header().Get(RequestIDHeader))
+	}
+}
+
+func TestNewLoggerLogfmt(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := NewLogger(LogFormatLogfmt, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("access", "status", 200)
+	if !strings.Contains(out.String(), "msg=access status=200") {
+		t.Errorf("Expected a logfmt line, got %q", out.String())
+	}
+
+	if _, err := NewLogger("xml", &out); err == nil {
+		t.Error("Expected an unknown format to be rejected")
+	}
+}
+
+func TestUseLogger(t *testing.T) {
+	defaultLogger, output, flags := slog.Default(), log.Writer(), log.Flags()
+	colors := []string{colorRed, colorGreen, colorYellow, colorBlue, colorPurple, colorCyan, colorWhite, colorReset}
+	t.Cleanup(func() {
+		slog.SetDefault(defaultLogger)
+		log.SetOutput(output)
+		log.SetFlags(flags)
+		colorRed, colorGreen, colorYellow, colorBlue, colorPurple, colorCyan, colorWhite, colorReset = colors[0], colors[1], colors[2], colors[3], colors[4], colors[5], colors[6], colors[7]
+	})
+
+	var out bytes.Buffer
+	logger, err := NewLogger(LogFormatJSON, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// On a terminal the standard logger keeps its colours and its own output
+	var terminal bytes.Buffer
+	log.SetOutput(&terminal)
+	useLogger(logger, true)
+	log.Printf("%sRejected certificate%s", colorRed, colorReset)
+	if !strings.Contains(terminal.String(), "\x1b[31mRejected certificate\x1b[0m") || out.Len() != 0 {
+		t.Errorf("Expected a coloured line on the terminal, got %q and %q", terminal.String(), out.String())
+	}
+
+	// Anywhere else it writes through the structured logger, without colours
+	useLogger(logger, false)
+	log.Printf("%sRejected certificate%s", colorRed, colorReset)
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a JSON log line, got %s", out.String())
+	}
+	if entry["msg"] != "Rejected certificate" {
+		t.Errorf("Expected the message without colours, got %q", entry["msg"])
+	}
+}
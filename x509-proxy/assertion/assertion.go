@@ -0,0 +1,150 @@
+package assertion
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Identity is the verified client identity the proxy vouches for
+type Identity struct {
+	DN     string
+	CN     string
+	Serial string
+}
+
+// Signer mints short-lived JWTs asserting the identity of the client certificate,
+// so the backend can tell identities set by the proxy from ones sent by anyone else.
+type Signer struct {
+	// Algorithm is the JWS algorithm, HS256, ES256 or RS256
+	Algorithm string
+	// Issuer is placed in the iss claim
+	Issuer string
+	// Audience is placed in the aud claim
+	Audience string
+	// TTL is how long an assertion is valid for
+	TTL time.Duration
+	key interface{}
+}
+
+// NewSigner returns a Signer using the given key.
+// HS256 takes the shared secret as []byte, ES256 an *ecdsa.PrivateKey and RS256 an *rsa.PrivateKey.
+func NewSigner(algorithm string, key interface{}, issuer string, audience string, ttl time.Duration) (*Signer, error) {
+	switch algorithm {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok || len(secret) < 32 {
+			return nil, fmt.Errorf("HS256 requires a shared secret of at least 32 bytes")
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok || ecKey.Curve.Params().BitSize != 256 {
+			return nil, fmt.Errorf("ES256 requires a P-256 ECDSA private key")
+		}
+	case "RS256":
+		if _, ok := key.(*rsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("RS256 requires an RSA private key")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported assertion algorithm %q", algorithm)
+	}
+
+	return &Signer{
+		Algorithm: algorithm,
+		Issuer:    issuer,
+		Audience:  audience,
+		TTL:       ttl,
+		key:       key,
+	}, nil
+}
+
+// LoadKey reads a signing key from disk.
+// For HS256 the file content is the shared secret, otherwise it must be a PEM encoded private key.
+func LoadKey(algorithm string, path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read assertion key: %v", err)
+	}
+
+	if algorithm == "HS256" {
+		return []byte(strings.TrimSpace(string(data))), nil
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse assertion key PEM")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported assertion key type %q", block.Type)
+}
+
+// Sign returns a compact serialized JWT for the identity
+func (s *Signer) Sign(identity Identity) (string, error) {
+	now := time.Now()
+
+	header, err := json.Marshal(map[string]string{
+		"alg": s.Algorithm,
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":    s.Issuer,
+		"aud":    s.Audience,
+		"sub":    identity.DN,
+		"cn":     identity.CN,
+		"serial": identity.Serial,
+		"iat":    now.Unix(),
+		"nbf":    now.Unix(),
+		"exp":    now.Add(s.TTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch key := s.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case *ecdsa.PrivateKey:
+		r, sv, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return "", fmt.Errorf("failed to sign assertion: %v", err)
+		}
+		// JWS encodes ECDSA signatures as the fixed size concatenation R || S
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		sv.FillBytes(signature[32:])
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", fmt.Errorf("failed to sign assertion: %v", err)
+		}
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
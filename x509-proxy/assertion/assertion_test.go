@@ -0,0 +1,106 @@
+package assertion
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decodeToken splits a token and returns the signing input, claims and signature
+func decodeToken(t *testing.T, token string) (string, map[string]interface{}, []byte) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Expected 3 token parts, got %d", len(parts))
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("Failed to decode claims: %v", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		t.Fatalf("Failed to parse claims: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("Failed to decode signature: %v", err)
+	}
+	return parts[0] + "." + parts[1], claims, signature
+}
+
+func TestSignHS256(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	signer, err := NewSigner("HS256", secret, "x509-proxy", "pwck8s", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	token, err := signer.Sign(Identity{DN: "CN=test,O=testO", CN: "test", Serial: "1f"})
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	signingInput, claims, signature := decodeToken(t, token)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		t.Error("Expected a valid HS256 signature")
+	}
+
+	if claims["sub"] != "CN=test,O=testO" {
+		t.Errorf("Expected sub to be CN=test,O=testO, got %v", claims["sub"])
+	}
+	if claims["cn"] != "test" || claims["serial"] != "1f" {
+		t.Errorf("Expected cn and serial claims, got %v", claims)
+	}
+	if claims["iss"] != "x509-proxy" || claims["aud"] != "pwck8s" {
+		t.Errorf("Expected iss and aud claims, got %v", claims)
+	}
+	exp := int64(claims["exp"].(float64))
+	if exp > time.Now().Add(time.Minute).Unix() || exp < time.Now().Unix() {
+		t.Errorf("Expected exp within the TTL, got %d", exp)
+	}
+}
+
+func TestSignES256(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSigner("ES256", key, "x509-proxy", "pwck8s", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	token, err := signer.Sign(Identity{DN: "CN=test", CN: "test", Serial: "1"})
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	signingInput, _, signature := decodeToken(t, token)
+	if len(signature) != 64 {
+		t.Fatalf("Expected a 64 byte signature, got %d", len(signature))
+	}
+	digest := sha256.Sum256([]byte(signingInput))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Error("Expected a valid ES256 signature")
+	}
+}
+
+func TestNewSignerRejectsWeakKeys(t *testing.T) {
+	if _, err := NewSigner("HS256", []byte("short"), "x509-proxy", "pwck8s", time.Minute); err == nil {
+		t.Error("Expected a short HS256 secret to be rejected")
+	}
+	if _, err := NewSigner("none", []byte("0123456789abcdef0123456789abcdef"), "x509-proxy", "pwck8s", time.Minute); err == nil {
+		t.Error("Expected an unsupported algorithm to be rejected")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/x509"
+	"dn"
+	"encoding/asn1"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	// oidUserPrincipalName is the Microsoft UPN otherName, used by smart card logon certificates
+	oidUserPrincipalName = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+)
+
+// certificateField extracts the values of one field from a certificate
+type certificateField func(cert *x509.Certificate) []string
+
+// parseCertificateField resolves a field name used in HTTP_HEADER_FIELDS:
+//
+//	subject, subject.<attr>   the subject DN or one of its attributes, for example subject.OU
+//	issuer, issuer.<attr>     the issuer DN or one of its attributes
+//	san.email, san.dns, san.uri, san.ip, san.upn
+//	serial                    the serial number in hex, as in the identity assertion
+//	fingerprint               the SHA-256 fingerprint in hex
+//	notBefore, notAfter       the validity dates in RFC 3339
+func parseCertificateField(field string) (certificateField, error) {
+	source, attribute, hasAttribute := strings.Cut(strings.TrimSpace(field), ".")
+	if hasAttribute && attribute == "" {
+		return nil, fmt.Errorf("certificate field %q has an empty attribute", field)
+	}
+
+	switch strings.ToLower(source) {
+	case "subject":
+		if !hasAttribute {
+			return func(cert *x509.Certificate) []string {
+				return []string{dn.FromName(cert.Subject).String()}
+			}, nil
+		}
+		return func(cert *x509.Certificate) []string {
+			return dn.FromName(cert.Subject).Get(attribute)
+		}, nil
+
+	case "issuer":
+		if !hasAttribute {
+			return func(cert *x509.Certificate) []string {
+				return []string{dn.FromName(cert.Issuer).String()}
+			}, nil
+		}
+		return func(cert *x509.Certificate) []string {
+			return dn.FromName(cert.Issuer).Get(attribute)
+		}, nil
+
+	case "san":
+		switch strings.ToLower(attribute) {
+		case "email":
+			return func(cert *x509.Certificate) []string { return cert.EmailAddresses }, nil
+		case "dns":
+			return func(cert *x509.Certificate) []string { return cert.DNSNames }, nil
+		case "uri":
+			return func(cert *x509.Certificate) []string {
+				var uris []string
+				for _, uri := range cert.URIs {
+					uris = append(uris, uri.String())
+				}
+				return uris
+			}, nil
+		case "ip":
+			return func(cert *x509.Certificate) []string {
+				var ips []string
+				for _, ip := range cert.IPAddresses {
+					ips = append(ips, ip.String())
+				}
+				return ips
+			}, nil
+		case "upn":
+			return userPrincipalNames, nil
+		}
+
+	case "serial":
+		if !hasAttribute {
+			return func(cert *x509.Certificate) []string {
+				if cert.SerialNumber == nil {
+					return nil
+				}
+				return []string{cert.SerialNumber.Text(16)}
+			}, nil
+		}
+
+	case "fingerprint":
+		if !hasAttribute {
+			return func(cert *x509.Certificate) []string { return []string{Fingerprint(cert)} }, nil
+		}
+
+	case "notbefore":
+		if !hasAttribute {
+			return func(cert *x509.Certificate) []string {
+				return []string{cert.NotBefore.UTC().Format(time.RFC3339)}
+			}, nil
+		}
+
+	case "notafter":
+		if !hasAttribute {
+			return func(cert *x509.Certificate) []string {
+				return []string{cert.NotAfter.UTC().Format(time.RFC3339)}
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown certificate field %q", field)
+}
+
+// ParseHeaderFields parses a comma separated list of Header=field mappings
+func ParseHeaderFields(value string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for _, mapping := range splitList(value) {
+		header, field, found := strings.Cut(mapping, "=")
+		header, field = strings.TrimSpace(header), strings.TrimSpace(field)
+		if !found || header == "" || field == "" {
+			return nil, fmt.Errorf("invalid header mapping %q, expected Header=field", mapping)
+		}
+		if _, err := parseCertificateField(field); err != nil {
+			return nil, err
+		}
+		fields[header] = field
+	}
+	return fields, nil
+}
+
+// CertificateHeaders returns the header values of the given Header=field mappings for a certificate.
+// Fields with several values, such as multiple email SANs, are joined with ", ".
+// Headers whose field is empty in the certificate are left out.
+func CertificateHeaders(cert *x509.Certificate, fields map[string]string) (map[string]string, error) {
+	headers := make(map[string]string, len(fields))
+	for header, field := range fields {
+		extract, err := parseCertificateField(field)
+		if err != nil {
+			return nil, err
+		}
+		values := extract(cert)
+		if len(values) == 0 {
+			continue
+		}
+		headers[header] = sanitizeHeaderValue(strings.Join(values, ", "))
+	}
+	return headers, nil
+}
+
+// sortedHeaders returns the header names of the mappings in a stable order
+func sortedHeaders(fields map[string]string) []string {
+	headers := make([]string, 0, len(fields))
+	for header := range fields {
+		headers = append(headers, header)
+	}
+	sort.Strings(headers)
+	return headers
+}
+
+// sanitizeHeaderValue replaces control characters, which are valid in a certificate but not in a header
+func sanitizeHeaderValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if (r < 0x20 && r != '\t') || r == 0x7f {
+			return '?'
+		}
+		return r
+	}, value)
+}
+
+// otherName is the otherName choice of a GeneralName, Value is the [0] EXPLICIT wrapped value
+type otherName struct {
+	TypeID asn1.ObjectIdentifier
+	Value  asn1.RawValue
+}
+
+// userPrincipalNames returns the UPN otherNames of the subject alternative name extension,
+// crypto/x509 does not parse otherNames itself.
+func userPrincipalNames(cert *x509.Certificate) []string {
+	var upns []string
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return nil
+		}
+		for _, name := range names {
+			// otherName is [0] IMPLICIT
+			if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+				continue
+			}
+			var other otherName
+			if _, err := asn1.UnmarshalWithParams(name.FullBytes, &other, "tag:0"); err != nil {
+				continue
+			}
+			if !other.TypeID.Equal(oidUserPrincipalName) || other.Value.Class != asn1.ClassContextSpecific || other.Value.Tag != 0 {
+				continue
+			}
+			var upn string
+			if _, err := asn1.Unmarshal(other.Value.Bytes, &upn); err == nil {
+				upns = append(upns, upn)
+			}
+		}
+	}
+	return upns
+}
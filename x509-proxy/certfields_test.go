@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+	"x509-proxy/x509toolkit"
+)
+
+// upnExtension builds a subject alternative name extension with an email, a URI and a UPN otherName
+func upnExtension(t *testing.T, email string, uri string, upn string) pkix.Extension {
+	value, err := asn1.Marshal(upn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := asn1.MarshalWithParams(otherName{
+		TypeID: oidUserPrincipalName,
+		Value:  asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value},
+	}, "tag:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := asn1.Marshal([]asn1.RawValue{
+		{FullBytes: other},
+		{Class: asn1.ClassContextSpecific, Tag: 1, Bytes: []byte(email)},
+		{Class: asn1.ClassContextSpecific, Tag: 6, Bytes: []byte(uri)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkix.Extension{Id: oidSubjectAltName, Value: names}
+}
+
+func TestCertificateHeaders(t *testing.T) {
+	ca, caKey, err := x509toolkit.GenerateCACertificate("test", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(255),
+		Subject:         pkix.Name{CommonName: "Jane Doe", OrganizationalUnit: []string{"CK8S"}, Organization: []string{"L.B. Cloud"}},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        notAfter,
+		ExtraExtensions: []pkix.Extension{upnExtension(t, "jane@example.com", "spiffe://example.com/jane", "jane@corp.example.com")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields, err := ParseHeaderFields("X-Email=san.email, X-Upn=san.upn, X-Uri=san.uri, X-Serial=serial, X-OU=subject.OU, " +
+		"X-Issuer-CN=issuer.CN, X-Fingerprint=fingerprint, X-Not-After=notAfter, X-Dns=san.dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, err := CertificateHeaders(cert, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"X-Email":       "jane@example.com",
+		"X-Upn":         "jane@corp.example.com",
+		"X-Uri":         "spiffe://example.com/jane",
+		"X-Serial":      "ff",
+		"X-OU":          "CK8S",
+		"X-Issuer-CN":   "test",
+		"X-Fingerprint": Fingerprint(cert),
+		"X-Not-After":   "2030-01-02T03:04:05Z",
+	}
+	for header, value := range expected {
+		if headers[header] != value {
+			t.Errorf("Expected %s to be %q, got %q", header, value, headers[header])
+		}
+	}
+	// Empty fields are left out
+	if _, found := headers["X-Dns"]; found {
+		t.Error("Expected no header for a certificate without DNS SANs")
+	}
+}
+
+func TestParseHeaderFieldsInvalid(t *testing.T) {
+	for _, value := range []string{"X-Email", "=san.email", "X-Email=san.phone", "X-Serial=serial.hex", "X-Subject=subject."} {
+		if _, err := ParseHeaderFields(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestSanitizeHeaderValue(t *testing.T) {
+	if got := sanitizeHeaderValue("CN=evil\r\nUserDN: CN=admin"); got != "CN=evil??UserDN: CN=admin" {
+		t.Errorf("Expected control characters to be replaced, got %q", got)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Certificate header encodings, all of them can be read by pwck8s's x509.ParseCertificate
+const (
+	// CertEncodingBase64PEM is the base64 encoding of the PEM certificates
+	CertEncodingBase64PEM = "base64-pem"
+	// CertEncodingURLPEM is the URL-escaped PEM certificates, like nginx's $ssl_client_escaped_cert
+	CertEncodingURLPEM = "url-pem"
+	// CertEncodingBase64DER is the base64 encoding of the DER certificates concatenated
+	CertEncodingBase64DER = "base64-der"
+)
+
+// ValidCertEncoding reports whether encoding is a supported certificate header encoding
+func ValidCertEncoding(encoding string) bool {
+	switch encoding {
+	case CertEncodingBase64PEM, CertEncodingURLPEM, CertEncodingBase64DER:
+		return true
+	}
+	return false
+}
+
+// EncodeCertificates encodes certificates for a single header value
+func EncodeCertificates(certs []*x509.Certificate, encoding string) (string, error) {
+	var pemBytes, derBytes []byte
+	for _, cert := range certs {
+		pemBytes = append(pemBytes, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		derBytes = append(derBytes, cert.Raw...)
+	}
+
+	switch encoding {
+	case CertEncodingBase64PEM:
+		return base64.StdEncoding.EncodeToString(pemBytes), nil
+	case CertEncodingURLPEM:
+		// Spaces as %20 rather than +, the way nginx escapes certificates
+		return strings.ReplaceAll(url.QueryEscape(string(pemBytes)), "+", "%20"), nil
+	case CertEncodingBase64DER:
+		return base64.StdEncoding.EncodeToString(derBytes), nil
+	}
+	return "", fmt.Errorf("unsupported certificate encoding %q", encoding)
+}
+
+// DecodeCertificates decodes a header value written with one of the encodings, the leaf certificate first
+func DecodeCertificates(value string, encoding string) ([]*x509.Certificate, error) {
+	var pemBytes []byte
+	switch encoding {
+	case CertEncodingBase64PEM:
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64: %v", err)
+		}
+		pemBytes = decoded
+	case CertEncodingURLPEM:
+		// PathUnescape keeps a literal + of the base64 data, QueryUnescape would turn it into a space
+		decoded, err := url.PathUnescape(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL escaping: %v", err)
+		}
+		pemBytes = []byte(decoded)
+	case CertEncodingBase64DER:
+		der, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64: %v", err)
+		}
+		certs, err := x509.ParseCertificates(der)
+		if err == nil && len(certs) == 0 {
+			err = fmt.Errorf("no certificate found")
+		}
+		return certs, err
+	default:
+		return nil, fmt.Errorf("unsupported certificate encoding %q", encoding)
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return certs, nil
+}
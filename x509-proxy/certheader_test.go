@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"x509-proxy/x509toolkit"
+)
+
+func TestEncodeCertificates(t *testing.T) {
+	ca, _, err := x509toolkit.GenerateCACertificate("test", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := []*x509.Certificate{ca}
+
+	// base64 PEM
+	value, err := EncodeCertificates(certs, CertEncodingBase64PEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatalf("Expected base64, got %v", err)
+	}
+	if block, _ := pem.Decode(decoded); block == nil || string(block.Bytes) != string(ca.Raw) {
+		t.Error("Expected the base64 PEM to hold the certificate")
+	}
+
+	// URL-escaped PEM, spaces are escaped as %20 like nginx does
+	value, err = EncodeCertificates(certs, CertEncodingURLPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unescaped, err := url.QueryUnescape(value)
+	if err != nil {
+		t.Fatalf("Expected URL-escaped value, got %v", err)
+	}
+	if block, _ := pem.Decode([]byte(unescaped)); block == nil || string(block.Bytes) != string(ca.Raw) {
+		t.Error("Expected the URL-escaped PEM to hold the certificate")
+	}
+
+	// base64 DER
+	value, err = EncodeCertificates(certs, CertEncodingBase64DER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != base64.StdEncoding.EncodeToString(ca.Raw) {
+		t.Error("Expected the base64 DER of the certificate")
+	}
+
+	if _, err := EncodeCertificates(certs, "pem"); err == nil {
+		t.Error("Expected an unknown encoding to fail")
+	}
+}
+
+func TestHandleProxyCertificate(t *testing.T) {
+	ca, _, err := x509toolkit.GenerateCACertificate("test", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpHeaderMap := HttpHeaderMap{
+		CN:               "CN",
+		DN:               "DN",
+		Certificate:      "X-Client-Certificate",
+		CertificateChain: "X-Client-Certificate-Chain",
+		CertEncoding:     CertEncodingBase64DER,
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{ca},
+		VerifiedChains:   [][]*x509.Certificate{{ca, ca}},
+	}
+
+	HandleProxy(httptest.NewRecorder(), req, GlobalConfig{}, &httputil.ReverseProxy{}, httpHeaderMap)
+
+	expected := base64.StdEncoding.EncodeToString(ca.Raw)
+	if got := req.Header.Get("X-Client-Certificate"); got != expected {
+		t.Errorf("Expected certificate header %s, got %s", expected, got)
+	}
+	if got := req.Header.Get("X-Client-Certificate-Chain"); got != expected {
+		t.Errorf("Expected chain header %s, got %s", expected, got)
+	}
+}
+
+func TestDecodeCertificates(t *testing.T) {
+	ca, caKey, err := x509toolkit.GenerateCACertificate("test", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := issueCertificate(t, ca, caKey, "leaf", x509.ExtKeyUsageClientAuth)
+	for _, encoding := range []string{CertEncodingBase64PEM, CertEncodingURLPEM, CertEncodingBase64DER} {
+		value, err := EncodeCertificates([]*x509.Certificate{leaf, ca}, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs, err := DecodeCertificates(value, encoding)
+		if err != nil {
+			t.Fatalf("Failed to decode %s: %v", encoding, err)
+		}
+		if len(certs) != 2 || !certs[0].Equal(leaf) || !certs[1].Equal(ca) {
+			t.Errorf("Expected the leaf and CA back from %s", encoding)
+		}
+		if _, err := DecodeCertificates("", encoding); err == nil {
+			t.Errorf("Expected an empty %s value to be rejected", encoding)
+		}
+	}
+	if _, err := DecodeCertificates("", "pem"); err == nil {
+		t.Error("Expected an unknown encoding to fail")
+	}
+}
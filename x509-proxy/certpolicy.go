@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"dn"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reasons a client certificate violates the certificate policy, used in logs and handshake errors
+const (
+	PolicyViolationPolicyOID     = "policy_oid"
+	PolicyViolationClientAuthEKU = "client_auth_eku"
+	PolicyViolationKeySize       = "key_size"
+	PolicyViolationValidity      = "validity"
+	PolicyViolationIssuer        = "issuer"
+)
+
+// PolicyViolation is the error of a client certificate rejected by the certificate policy
+type PolicyViolation struct {
+	// Reason is one of the PolicyViolation constants
+	Reason string
+	Detail string
+}
+
+func (v *PolicyViolation) Error() string {
+	return fmt.Sprintf("certificate policy violation (%s): %s", v.Reason, v.Detail)
+}
+
+// CertPolicy are the checks a verified client certificate must pass on top of chaining to the CA,
+// so certificates the CA issued for other purposes are rejected. Zero values disable a check.
+type CertPolicy struct {
+	// PolicyOIDs the certificate must assert at least one of in its certificate policies extension
+	PolicyOIDs []asn1.ObjectIdentifier
+	// RequireClientAuthEKU rejects certificates without the client authentication extended key usage.
+	// Without it a certificate with no extended key usage at all is accepted.
+	RequireClientAuthEKU bool
+	// MinRSABits and MinECDSABits are the smallest accepted key sizes
+	MinRSABits   int
+	MinECDSABits int
+	// MaxValidity is the longest accepted period between NotBefore and NotAfter
+	MaxValidity time.Duration
+	// AllowedIssuers are the canonical keys of the DNs that may issue client certificates
+	AllowedIssuers map[string]bool
+}
+
+// ParsePolicyOIDs parses dotted object identifiers such as 2.16.840.1.101.3.2.1.3.13
+func ParsePolicyOIDs(values []string) ([]asn1.ObjectIdentifier, error) {
+	var oids []asn1.ObjectIdentifier
+	for _, value := range values {
+		parts := strings.Split(value, ".")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid policy OID %q", value)
+		}
+		oid := make(asn1.ObjectIdentifier, len(parts))
+		for i, part := range parts {
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid policy OID %q", value)
+			}
+			oid[i] = n
+		}
+		oids = append(oids, oid)
+	}
+	return oids, nil
+}
+
+// ParseIssuers parses DNs in RFC 4514 or OpenSSL slash form into a set of canonical keys
+func ParseIssuers(values []string) (map[string]bool, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	issuers := make(map[string]bool)
+	var errs []error
+	for _, value := range values {
+		issuer, err := dn.Parse(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid issuer %q: %v", value, err))
+			continue
+		}
+		issuers[issuer.Key()] = true
+	}
+	return issuers, errors.Join(errs...)
+}
+
+// Check returns a *PolicyViolation for the first check cert fails, nil when it passes them all
+func (p *CertPolicy) Check(cert *x509.Certificate) error {
+	if len(p.PolicyOIDs) > 0 && !p.hasPolicy(cert) {
+		return &PolicyViolation{PolicyViolationPolicyOID, fmt.Sprintf("none of the required policies %v asserted", p.PolicyOIDs)}
+	}
+	if p.RequireClientAuthEKU && !hasExtKeyUsage(cert, x509.ExtKeyUsageClientAuth) {
+		return &PolicyViolation{PolicyViolationClientAuthEKU, "client authentication extended key usage missing"}
+	}
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if bits := key.N.BitLen(); bits < p.MinRSABits {
+			return &PolicyViolation{PolicyViolationKeySize, fmt.Sprintf("RSA key of %d bits, at least %d required", bits, p.MinRSABits)}
+		}
+	case *ecdsa.PublicKey:
+		if bits := key.Curve.Params().BitSize; bits < p.MinECDSABits {
+			return &PolicyViolation{PolicyViolationKeySize, fmt.Sprintf("ECDSA key of %d bits, at least %d required", bits, p.MinECDSABits)}
+		}
+	}
+	if validity := cert.NotAfter.Sub(cert.NotBefore); p.MaxValidity > 0 && validity > p.MaxValidity {
+		return &PolicyViolation{PolicyViolationValidity, fmt.Sprintf("valid for %s, at most %s allowed", validity, p.MaxValidity)}
+	}
+	if len(p.AllowedIssuers) > 0 {
+		if issuer := dn.FromName(cert.Issuer); !p.AllowedIssuers[issuer.Key()] {
+			return &PolicyViolation{PolicyViolationIssuer, fmt.Sprintf("issuer %s not allowed", issuer)}
+		}
+	}
+	return nil
+}
+
+// hasPolicy reports whether cert asserts one of the required policies
+func (p *CertPolicy) hasPolicy(cert *x509.Certificate) bool {
+	for _, required := range p.PolicyOIDs {
+		for _, policy := range cert.PolicyIdentifiers {
+			if policy.Equal(required) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasExtKeyUsage reports whether cert explicitly lists usage, the any usage does not count
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyConnection checks the client certificate during the TLS handshake, after the chain was verified.
+// Unlike VerifyPeerCertificate it also runs when a session is resumed, on the chains verified when it was created.
+// Rejections are logged with the subject and the reason.
+func (p *CertPolicy) VerifyConnection(state tls.ConnectionState) error {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	if err := p.Check(cert); err != nil {
+		log.Printf("%sRejected client certificate %s: %v%s", colorRed, dn.FromCertificate(cert), err, colorReset)
+		return err
+	}
+	return nil
+}
+
+// chainVerifiers runs tls.Config.VerifyConnection callbacks in order, stopping at the first error
+func chainVerifiers(verifiers ...func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		for _, verify := range verifiers {
+			if err := verify(state); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+	"x509-proxy/x509toolkit"
+)
+
+func TestCertPolicyCheck(t *testing.T) {
+	ca, caKey, err := x509toolkit.GenerateCACertificate("client-ca", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oids, err := ParsePolicyOIDs([]string{"2.16.840.1.101.3.2.1.3.13", "1.3.6.1.4.1.99999.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuers, err := ParseIssuers([]string{"CN=client-ca,OU=testOU,O=test,C=US"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &CertPolicy{
+		PolicyOIDs:           oids,
+		RequireClientAuthEKU: true,
+		MinRSABits:           2048,
+		MinECDSABits:         256,
+		MaxValidity:          30 * 24 * time.Hour,
+		AllowedIssuers:       issuers,
+	}
+
+	valid := func() *x509.Certificate {
+		return &x509.Certificate{
+			Subject:           pkix.Name{CommonName: "jane"},
+			ExtKeyUsage:       []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			PolicyIdentifiers: []asn1.ObjectIdentifier{{1, 3, 6, 1, 4, 1, 99999, 1}},
+		}
+	}
+	if err := policy.Check(signCertificate(t, ca, caKey, valid(), &ecKey.PublicKey)); err != nil {
+		t.Fatalf("Expected a valid certificate to pass, got %v", err)
+	}
+
+	noPolicy := valid()
+	noPolicy.PolicyIdentifiers = []asn1.ObjectIdentifier{{1, 2, 3}}
+	serverAuth := valid()
+	serverAuth.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	longLived := valid()
+	longLived.NotBefore, longLived.NotAfter = time.Now(), time.Now().Add(365*24*time.Hour)
+
+	otherCA, otherKey, err := x509toolkit.GenerateCACertificate("other-ca", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cert   *x509.Certificate
+		reason string
+	}{
+		{"policy", signCertificate(t, ca, caKey, noPolicy, &ecKey.PublicKey), PolicyViolationPolicyOID},
+		{"eku", signCertificate(t, ca, caKey, serverAuth, &ecKey.PublicKey), PolicyViolationClientAuthEKU},
+		{"rsa", signCertificate(t, ca, caKey, valid(), &rsaKey.PublicKey), PolicyViolationKeySize},
+		{"validity", signCertificate(t, ca, caKey, longLived, &ecKey.PublicKey), PolicyViolationValidity},
+		{"issuer", signCertificate(t, otherCA, otherKey, valid(), &ecKey.PublicKey), PolicyViolationIssuer},
+	}
+	for _, test := range tests {
+		var violation *PolicyViolation
+		if err := policy.Check(test.cert); !errors.As(err, &violation) || violation.Reason != test.reason {
+			t.Errorf("%s: expected a %s violation, got %v", test.name, test.reason, err)
+		}
+	}
+}
+
+func TestParsePolicyOIDs(t *testing.T) {
+	for _, value := range []string{"1", "1.2.x", "1..2", "1.-2"} {
+		if _, err := ParsePolicyOIDs([]string{value}); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestCertPolicyHandshake(t *testing.T) {
+	ca, caKey, err := x509toolkit.GenerateCACertificate("client-ca", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	policy := &CertPolicy{RequireClientAuthEKU: true}
+	var completed atomic.Int32
+	server.TLS = &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		VerifyConnection: chainVerifiers(policy.VerifyConnection, func(tls.ConnectionState) error {
+			completed.Add(1)
+			return nil
+		}),
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	request := func(usage x509.ExtKeyUsage) error {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := signCertificate(t, ca, caKey, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "jane"},
+			ExtKeyUsage: []x509.ExtKeyUsage{usage},
+		}, &key.PublicKey)
+		// A new transport for each request, so every request makes its own handshake
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = []tls.Certificate{{
+			Certificate: [][]byte{cert.Raw},
+			PrivateKey:  key,
+		}}
+		defer transport.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := request(x509.ExtKeyUsageClientAuth); err != nil {
+		t.Fatalf("Expected a client auth certificate to be accepted, got %v", err)
+	}
+	// Any usage passes the standard verification, but not the policy
+	if err := request(x509.ExtKeyUsageAny); err == nil {
+		t.Error("Expected a certificate without the client auth usage to be rejected")
+	}
+	if completed.Load() != 1 {
+		t.Errorf("Expected only the accepted handshake to complete, got %d", completed.Load())
+	}
+	if reason := HandshakeFailureReason("remote error: certificate policy violation (client_auth_eku): missing"); reason != "certificate_policy" {
+		t.Errorf("Expected certificate_policy, got %s", reason)
+	}
+}
+
+func TestCertPolicyIssuerRepeatedOU(t *testing.T) {
+	// Like the DoD CAs, the issuer has two OUs whose order tells it apart from another DN
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "DOD ID CA-59",
+			OrganizationalUnit: []string{"DoD", "PKI"},
+			Organization:       []string{"U.S. Government"},
+			Country:            []string{"US"},
+		},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	ca := signCertificate(t, template, caKey, template, &caKey.PublicKey)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := signCertificate(t, ca, caKey, &x509.Certificate{Subject: pkix.Name{CommonName: "jane"}}, &key.PublicKey)
+
+	for issuer, allowed := range map[string]bool{
+		"CN=DOD ID CA-59,OU=PKI,OU=DoD,O=U.S. Government,C=US":  true,
+		"/C=US/O=U.S. Government/OU=DoD/OU=PKI/CN=DOD ID CA-59": true,
+		"CN=DOD ID CA-59,OU=DoD,OU=PKI,O=U.S. Government,C=US":  false,
+		"CN=DOD ID CA-59,OU=PKI,O=U.S. Government,C=US":         false,
+	} {
+		issuers, err := ParseIssuers([]string{issuer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		policy := &CertPolicy{AllowedIssuers: issuers}
+		if err := policy.Check(cert); (err == nil) != allowed {
+			t.Errorf("%s: expected allowed %v, got %v", issuer, allowed, err)
+		}
+	}
+}
+
+func TestCertPolicyResumedSession(t *testing.T) {
+	ca, caKey, err := x509toolkit.GenerateCACertificate("client-ca", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	otherIssuers, err := ParseIssuers([]string{"CN=other-ca,OU=testOU,O=test,C=US"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var policy atomic.Pointer[CertPolicy]
+	policy.Store(&CertPolicy{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return policy.Load().VerifyConnection(state)
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{clientCertificate(t, ca, caKey, "jane")}
+	transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	defer transport.CloseIdleConnections()
+	request := func() (*http.Response, error) {
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		transport.CloseIdleConnections()
+		return resp, err
+	}
+
+	if _, err := request(); err != nil {
+		t.Fatalf("Expected the certificate to be accepted, got %v", err)
+	}
+	resp, err := request()
+	if err != nil || !resp.TLS.DidResume {
+		t.Fatalf("Expected the session to be resumed, got %v", err)
+	}
+
+	// A session created before the policy changed must not get around it
+	policy.Store(&CertPolicy{AllowedIssuers: otherIssuers})
+	if _, err := request(); err == nil {
+		t.Error("Expected the resumed session to be rejected by the policy")
+	}
+}
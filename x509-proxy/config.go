@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigFileEnv is the variable holding the path of the config file, the --config flag takes precedence
+const ConfigFileEnv = "CONFIG_FILE"
+
+// Kinds of values a setting accepts in the config file
+const (
+	settingString = iota
+	settingInt
+	settingFloat
+	settingBool
+	settingDuration
+	// settingList is a comma separated string or an array of strings
+	settingList
+	// settingDNList is a semicolon separated string or an array of DNs
+	settingDNList
+	// settingRoutes is an array of Route objects
+	settingRoutes
+	// settingFields is a comma separated string or an object of header names to certificate fields
+	settingFields
+	// settingTLSHosts is an array of TLSHost objects
+	settingTLSHosts
+)
+
+// settings are the config file keys, each is the lower case name of its environment variable
+var settings = map[string]int{
+	"PORT":                         settingInt,
+	"TLS_CERT":                     settingString,
+	"TLS_KEY":                      settingString,
+	"CA_CERT":                      settingString,
+	"TLS_HOSTS":                    settingTLSHosts,
+	"PROXY_URL":                    settingString,
+	"ROUTES":                       settingRoutes,
+	"STREAM_IDLE_TIMEOUT":          settingDuration,
+	"STREAM_MAX_DURATION":          settingDuration,
+	"UPSTREAM_CA":                  settingString,
+	"UPSTREAM_SERVER_NAME":         settingString,
+	"UPSTREAM_CLIENT_CERT":         settingString,
+	"UPSTREAM_CLIENT_KEY":          settingString,
+	"TLS_MIN_VERSION":              settingString,
+	"TLS_CIPHER_SUITES":            settingList,
+	"SERVER_READ_HEADER_TIMEOUT":   settingDuration,
+	"SERVER_READ_TIMEOUT":          settingDuration,
+	"SERVER_WRITE_TIMEOUT":         settingDuration,
+	"SERVER_IDLE_TIMEOUT":          settingDuration,
+	"SERVER_MAX_HEADER_BYTES":      settingInt,
+	"PROXY_PROTOCOL_TRUSTED_CIDRS": settingList,
+	"INGRESS_CERT_HEADER":          settingString,
+	"INGRESS_CERT_ENCODING":        settingString,
+	"INGRESS_TRUSTED_CIDRS":        settingList,
+	"DEBUG":                        settingBool,
+	"LOG_FORMAT":                   settingString,
+	"METRICS_PORT":                 settingInt,
+	"HEALTH_PORT":                  settingInt,
+	"READINESS_TIMEOUT":            settingDuration,
+	"SHUTDOWN_DELAY":               settingDuration,
+	"DRAIN_PERIOD":                 settingDuration,
+	"CERT_RELOAD_INTERVAL":         settingDuration,
+	"CLIENT_CERT_EXPIRY_WARNING":   settingDuration,
+	"HTTP_HEADER_CN":               settingString,
+	"HTTP_HEADER_DN":               settingString,
+	"HTTP_HEADER_CERT":             settingString,
+	"HTTP_HEADER_CERT_CHAIN":       settingString,
+	"HTTP_HEADER_CERT_ENCODING":    settingString,
+	"HTTP_HEADER_FIELDS":           settingFields,
+	"TRUSTED_HEADERS":              settingList,
+	"ASSERTION_KEY":                settingString,
+	"ASSERTION_ALG":                settingString,
+	"ASSERTION_HEADER":             settingString,
+	"ASSERTION_ISSUER":             settingString,
+	"ASSERTION_AUDIENCE":           settingString,
+	"ASSERTION_TTL":                settingDuration,
+	"CRL_FILES":                    settingList,
+	"CRL_REFRESH":                  settingDuration,
+	"OCSP_URL":                     settingString,
+	"OCSP_ENABLED":                 settingBool,
+	"REVOCATION_FAIL_MODE":         settingString,
+	"REVOCATION_CACHE_TTL":         settingDuration,
+	"CERT_POLICY_OIDS":             settingList,
+	"CERT_REQUIRE_CLIENT_AUTH":     settingBool,
+	"CERT_MIN_RSA_BITS":            settingInt,
+	"CERT_MIN_ECDSA_BITS":          settingInt,
+	"CERT_MAX_VALIDITY":            settingDuration,
+	"CERT_ALLOWED_ISSUERS":         settingDNList,
+	"PATH_POLICY":                  settingList,
+	"PATH_POLICY_DEFAULT":          settingString,
+	"RATE_LIMIT":                   settingFloat,
+	"RATE_LIMIT_BURST":             settingInt,
+	"RATE_LIMIT_KEY":               settingString,
+	"RATE_LIMIT_IP":                settingFloat,
+	"RATE_LIMIT_IP_BURST":          settingInt,
+	"RATE_LIMIT_METHODS":           settingList,
+	"RATE_LIMIT_MAX_KEYS":          settingInt,
+}
+
+// fileSettings are the values read from the config file by variable name, environment variables take precedence
+var fileSettings map[string]string
+
+// getSetting returns the environment variable, or the config file value when the variable is empty
+func getSetting(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fileSettings[name]
+}
+
+// lookupSetting is getSetting for settings where an empty value differs from an unset one.
+// A variable set to an empty value overrides the config file.
+func lookupSetting(name string) (string, bool) {
+	if value, found := os.LookupEnv(name); found {
+		return value, true
+	}
+	value, found := fileSettings[name]
+	return value, found
+}
+
+// LoadConfigFile reads a JSON config file into setting values by variable name.
+// Every unknown key and value of the wrong type is reported, the valid values are returned either way.
+func LoadConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var file map[string]any
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	values := make(map[string]string)
+	var errs []error
+	for _, key := range sortedKeys(file) {
+		name := strings.ToUpper(key)
+		kind, known := settings[name]
+		if !known || key != strings.ToLower(name) {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", path, key))
+			continue
+		}
+		value, err := settingValue(kind, file[key])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s %v", path, key, err))
+			continue
+		}
+		values[name] = value
+	}
+	return values, errors.Join(errs...)
+}
+
+// settingValue converts a config file value to the string its environment variable would hold
+func settingValue(kind int, value any) (string, error) {
+	switch kind {
+	case settingString:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return "", errors.New("must be a string")
+	case settingInt:
+		if n, ok := value.(json.Number); ok {
+			if _, err := n.Int64(); err == nil {
+				return n.String(), nil
+			}
+		}
+		return "", errors.New("must be an integer")
+	case settingFloat:
+		if n, ok := value.(json.Number); ok {
+			return n.String(), nil
+		}
+		return "", errors.New("must be a number")
+	case settingBool:
+		if b, ok := value.(bool); ok {
+			return fmt.Sprint(b), nil
+		}
+		return "", errors.New("must be true or false")
+	case settingDuration:
+		if s, ok := value.(string); ok {
+			if _, err := time.ParseDuration(s); err != nil {
+				return "", fmt.Errorf("must be a duration such as \"30s\": %v", err)
+			}
+			return s, nil
+		}
+		return "", errors.New("must be a duration such as \"30s\"")
+	case settingList, settingDNList:
+		separator := ","
+		if kind == settingDNList {
+			separator = ";"
+		}
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		items, ok := value.([]any)
+		if !ok {
+			return "", errors.New("must be a string or an array of strings")
+		}
+		var list []string
+		for _, item := range items {
+			s, ok := item.(string)
+			if !ok || strings.Contains(s, separator) {
+				return "", fmt.Errorf("must be an array of strings without %q", separator)
+			}
+			list = append(list, s)
+		}
+		return strings.Join(list, separator), nil
+	case settingRoutes:
+		if _, ok := value.([]any); !ok {
+			return "", errors.New("must be an array of routes")
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		if _, err := ParseRoutes(string(data)); err != nil {
+			return "", err
+		}
+		return string(data), nil
+	case settingTLSHosts:
+		if _, ok := value.([]any); !ok {
+			return "", errors.New("must be an array of TLS hosts")
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		if _, err := ParseTLSHosts(string(data)); err != nil {
+			return "", err
+		}
+		return string(data), nil
+	case settingFields:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		fields, ok := value.(map[string]any)
+		if !ok {
+			return "", errors.New("must be a string or an object of headers to certificate fields")
+		}
+		var mappings []string
+		for _, header := range sortedKeys(fields) {
+			field, ok := fields[header].(string)
+			if !ok {
+				return "", fmt.Errorf("field of header %s must be a string", header)
+			}
+			mappings = append(mappings, header+"="+field)
+		}
+		return strings.Join(mappings, ","), nil
+	}
+	return "", fmt.Errorf("unknown setting kind %d", kind)
+}
+
+// CheckConfig loads the certificates and builds the routes of a config without serving anything,
+// so --check-config also catches unreadable certificates and invalid routes.
+func CheckConfig(config GlobalConfig) error {
+	var errs []error
+	if config.TLSCert != "" && config.TLSKey != "" || len(config.TLSHosts) > 0 {
+		if _, err := NewServerCertificates(config); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(config.Routes) > 0 {
+		if _, err := NewRouter(config.Routes); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sortedKeys returns the keys of a map in order, so errors are reported in a stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"x509-proxy/x509toolkit"
+)
+
+// unsetSettings clears every setting from the environment and the config file for the test
+func unsetSettings(t *testing.T) {
+	for name := range settings {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	t.Cleanup(func() { fileSettings = nil })
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"port": 8443,
+		"debug": true,
+		"rate_limit": 2.5,
+		"trusted_headers": ["UserDN", "Authorization"],
+		"http_header_fields": {"X-Client-Serial": "serial", "X-Client-Email": "san.email"},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "http://backend:8080", "timeout": "30s"}]
+	}`)
+	values, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"PORT":               "8443",
+		"DEBUG":              "true",
+		"RATE_LIMIT":         "2.5",
+		"TRUSTED_HEADERS":    "UserDN,Authorization",
+		"HTTP_HEADER_FIELDS": "X-Client-Email=san.email,X-Client-Serial=serial",
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("Expected %s to be %q, got %q", name, value, values[name])
+		}
+	}
+	routes, err := ParseRoutes(values["ROUTES"])
+	if err != nil || len(routes) != 1 || routes[0].Name != "api" || routes[0].Timeout != Duration(30*time.Second) {
+		t.Errorf("Expected the api route, got %+v (%v)", routes, err)
+	}
+}
+
+func TestLoadConfigFileReportsEveryError(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"port": "8443",
+		"Debug": true,
+		"proxy": "http://backend",
+		"cert_reload_interval": "soon",
+		"crl_files": [1],
+		"routes": [{"name": "api", "upstreams": "http://backend"}],
+		"tls_cert": "/pki/tls.crt"
+	}`)
+	values, err := LoadConfigFile(path)
+	if err == nil {
+		t.Fatal("Expected the config file to be rejected")
+	}
+	for _, message := range []string{
+		`port must be an integer`,
+		`unknown setting "Debug"`,
+		`unknown setting "proxy"`,
+		`cert_reload_interval must be a duration`,
+		`crl_files must be an array of strings`,
+		`routes invalid routes`,
+	} {
+		if !strings.Contains(err.Error(), message) {
+			t.Errorf("Expected %q in:\n%v", message, err)
+		}
+	}
+	if values["TLS_CERT"] != "/pki/tls.crt" {
+		t.Errorf("Expected the valid settings to be returned, got %v", values)
+	}
+
+	if _, err := LoadConfigFile(writeConfigFile(t, `{"port": 8443,}`)); err == nil {
+		t.Error("Expected invalid JSON to be rejected")
+	}
+}
+
+func TestHandleConfigEnvOverridesFile(t *testing.T) {
+	unsetSettings(t)
+	caCert, _, err := x509toolkit.GenerateCACertificate("test", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPath := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeConfigFile(t, `{
+		"port": 8443,
+		"tls_cert": "/pki/tls.crt",
+		"tls_key": "/pki/tls.key",
+		"ca_cert": "`+caPath+`",
+		"proxy_url": "http://backend:8080",
+		"metrics_port": 0,
+		"http_header_cn": "X-File-Cn",
+		"http_header_cert": "X-File-Certificate"
+	}`)
+	t.Setenv("PORT", "9443")
+	t.Setenv("HTTP_HEADER_CERT", "")
+
+	config, httpHeaderMap, err := HandleConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Port != 9443 {
+		t.Errorf("Expected PORT to override the file, got %d", config.Port)
+	}
+	if config.TLSCert != "/pki/tls.crt" || config.ProxyURL != "http://backend:8080" || config.MetricsPort != 0 {
+		t.Errorf("Expected the file settings, got %+v", config)
+	}
+	if config.LogFormat != LogFormatJSON || config.CertReloadInterval != 30*time.Second {
+		t.Errorf("Expected the defaults, got %+v", config)
+	}
+	if httpHeaderMap.CN != "X-File-Cn" {
+		t.Errorf("Expected the CN header from the file, got %s", httpHeaderMap.CN)
+	}
+	if httpHeaderMap.Certificate != "" {
+		t.Errorf("Expected an empty variable to disable the certificate header, got %s", httpHeaderMap.Certificate)
+	}
+}
+
+func TestHandleConfigReportsEveryError(t *testing.T) {
+	unsetSettings(t)
+	t.Setenv("LOG_FORMAT", "xml")
+	t.Setenv("HTTP_HEADER_FIELDS", "X-Client-Phone=san.phone")
+
+	_, _, err := HandleConfig(writeConfigFile(t, `{"debug": "yes", "path_policy": ["/api/=sometimes"]}`))
+	if err == nil {
+		t.Fatal("Expected the config to be rejected")
+	}
+	for _, message := range []string{
+		"debug must be true or false",
+		"PORT must be set",
+		"TLS_CERT must be set",
+		"TLS_KEY must be set",
+		"CA_CERT must be set",
+		"PROXY_URL or ROUTES must be set",
+		"invalid LOG_FORMAT",
+		"invalid path policy",
+		"invalid HTTP_HEADER_FIELDS",
+	} {
+		if !strings.Contains(err.Error(), message) {
+			t.Errorf("Expected %q in:\n%v", message, err)
+		}
+	}
+}
+
+func TestHandleConfigTLSHosts(t *testing.T) {
+	unsetSettings(t)
+
+	// Every host has its own CA, so neither TLS_CERT nor CA_CERT is needed
+	config, _, err := HandleConfig(writeConfigFile(t, `{
+		"port": 8443,
+		"proxy_url": "http://backend:8080",
+		"tls_hosts": [
+			{"hosts": ["ui.example.com"], "cert": "/pki/ui.crt", "key": "/pki/ui.key", "ca": "/pki/ui-ca.crt"},
+			{"hosts": ["*.sandbox.example.com"], "cert": "/pki/sandbox.crt", "key": "/pki/sandbox.key", "ca": "/pki/sandbox-ca.crt"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.TLSHosts) != 2 || config.TLSHosts[1].Hosts[0] != "*.sandbox.example.com" {
+		t.Errorf("Expected the TLS hosts of the file, got %+v", config.TLSHosts)
+	}
+
+	// A host without its own CA falls back to CA_CERT
+	_, _, err = HandleConfig(writeConfigFile(t, `{
+		"port": 8443,
+		"proxy_url": "http://backend:8080",
+		"tls_hosts": [{"cert": "/pki/ui.crt", "key": "/pki/ui.key"}]
+	}`))
+	if err == nil || !strings.Contains(err.Error(), "CA_CERT must be set") || strings.Contains(err.Error(), "TLS_CERT") {
+		t.Errorf("Expected only CA_CERT to be required, got %v", err)
+	}
+}
+
+func TestGetIngressPassthroughFromEnv(t *testing.T) {
+	unsetSettings(t)
+	if ingress, err := GetIngressPassthroughFromEnv(); ingress != nil || err != nil {
+		t.Errorf("Expected passthrough to be disabled by default, got %+v, %v", ingress, err)
+	}
+
+	t.Setenv("INGRESS_CERT_HEADER", "ssl-client-cert")
+	if _, err := GetIngressPassthroughFromEnv(); err == nil || !strings.Contains(err.Error(), "INGRESS_TRUSTED_CIDRS must be set") {
+		t.Errorf("Expected the trusted addresses to be required, got %v", err)
+	}
+
+	t.Setenv("INGRESS_TRUSTED_CIDRS", "10.0.0.0/8, 192.0.2.10")
+	ingress, err := GetIngressPassthroughFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ingress.Header != "ssl-client-cert" || ingress.Encoding != CertEncodingURLPEM || len(ingress.Trusted) != 2 {
+		t.Errorf("Unexpected passthrough settings %+v", ingress)
+	}
+
+	t.Setenv("PROXY_PROTOCOL_TRUSTED_CIDRS", "10.20.0.0/16")
+	if _, err := GetIngressPassthroughFromEnv(); err == nil || !strings.Contains(err.Error(), "must not overlap") {
+		t.Errorf("Expected an ingress behind a PROXY protocol load balancer to be rejected, got %v", err)
+	}
+	t.Setenv("PROXY_PROTOCOL_TRUSTED_CIDRS", "")
+
+	t.Setenv("INGRESS_CERT_ENCODING", "pem")
+	if _, err := GetIngressPassthroughFromEnv(); err == nil {
+		t.Error("Expected an unknown encoding to be rejected")
+	}
+
+	t.Setenv("INGRESS_CERT_HEADER", "")
+	if _, err := GetIngressPassthroughFromEnv(); err == nil {
+		t.Error("Expected trusted addresses without a header to be rejected")
+	}
+}
@@ -1,3 +1,9 @@
 module x509-proxy
 
 go 1.21.3
+
+require dn v0.0.0
+
+require golang.org/x/crypto v0.17.0
+
+replace dn => ../dn
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Health serves the liveness and readiness probes in plain HTTP, so the kubelet needs no client certificate
+type Health struct {
+	router *Router
+	// timeout bounds the connection to each upstream when checking readiness
+	timeout time.Duration
+	// draining is set once the proxy is shutting down, so it is taken out of the Service first
+	draining atomic.Bool
+}
+
+// NewHealth returns the probes of a proxy forwarding to the upstreams of router
+func NewHealth(router *Router, timeout time.Duration) *Health {
+	return &Health{router: router, timeout: timeout}
+}
+
+// Drain makes the readiness probe fail from now on, the liveness probe keeps passing
+func (h *Health) Drain() {
+	h.draining.Store(true)
+}
+
+// Handler serves /healthz for liveness and /readyz for readiness
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeProbe(w, http.StatusOK, "ok")
+	})
+	mux.HandleFunc("/readyz", h.serveReadiness)
+	return mux
+}
+
+// serveReadiness reports ready when the proxy is not draining and every upstream accepts connections
+func (h *Health) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	if h.draining.Load() {
+		writeProbe(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	status := http.StatusOK
+	var lines []string
+	for _, check := range h.checkUpstreams(ctx) {
+		if check.err != nil {
+			status = http.StatusServiceUnavailable
+			lines = append(lines, fmt.Sprintf("%s: %v", check.upstream, check.err))
+		} else {
+			lines = append(lines, check.upstream+": ok")
+		}
+	}
+	writeProbe(w, status, strings.Join(lines, "\n"))
+}
+
+// upstreamCheck is the result of connecting to one upstream
+type upstreamCheck struct {
+	upstream string
+	err      error
+}
+
+// checkUpstreams connects to every distinct upstream of the router in parallel
+func (h *Health) checkUpstreams(ctx context.Context) []upstreamCheck {
+	addresses := make(map[string]bool)
+	for _, route := range h.router.routes {
+		addresses[upstreamAddress(route)] = true
+	}
+
+	var wg sync.WaitGroup
+	checks := make([]upstreamCheck, 0, len(addresses))
+	var mu sync.Mutex
+	var dialer net.Dialer
+	for address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			conn, err := dialer.DialContext(ctx, "tcp", address)
+			if err == nil {
+				conn.Close()
+			}
+			mu.Lock()
+			checks = append(checks, upstreamCheck{upstream: address, err: err})
+			mu.Unlock()
+		}(address)
+	}
+	wg.Wait()
+	sort.Slice(checks, func(i, j int) bool { return checks[i].upstream < checks[j].upstream })
+	return checks
+}
+
+// upstreamAddress returns the host:port of a route's upstream, with the default port of its scheme
+func upstreamAddress(route *Route) string {
+	if route.target.Port() != "" {
+		return route.target.Host
+	}
+	port := "80"
+	if route.target.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(route.target.Hostname(), port)
+}
+
+// writeProbe writes a plain text probe answer that is never cached
+func writeProbe(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, body)
+}
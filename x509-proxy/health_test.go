@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func probe(t *testing.T, handler http.Handler, path string) (int, string) {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+	return rr.Code, rr.Body.String()
+}
+
+func TestHealth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	router, err := NewRouter([]Route{
+		{Name: "api", Prefix: "/api/", Upstream: upstream.URL},
+		{Name: "frontend", Upstream: upstream.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	health := NewHealth(router, time.Second)
+	handler := health.Handler()
+
+	if status, _ := probe(t, handler, "/healthz"); status != http.StatusOK {
+		t.Errorf("Expected liveness to pass, got %d", status)
+	}
+	status, body := probe(t, handler, "/readyz")
+	if status != http.StatusOK || strings.Count(body, ": ok") != 1 {
+		t.Errorf("Expected readiness to check the shared upstream once, got %d %q", status, body)
+	}
+
+	health.Drain()
+	if status, body := probe(t, handler, "/readyz"); status != http.StatusServiceUnavailable || !strings.Contains(body, "shutting down") {
+		t.Errorf("Expected readiness to fail while draining, got %d %q", status, body)
+	}
+	if status, _ := probe(t, handler, "/healthz"); status != http.StatusOK {
+		t.Errorf("Expected liveness to pass while draining, got %d", status)
+	}
+}
+
+func TestHealthUnreachableUpstream(t *testing.T) {
+	// A port nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	router, err := NewRouter([]Route{{Name: "api", Upstream: address}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, body := probe(t, NewHealth(router, time.Second).Handler(), "/readyz")
+	if status != http.StatusServiceUnavailable || !strings.Contains(body, address) {
+		t.Errorf("Expected readiness to fail for %s, got %d %q", address, status, body)
+	}
+}
+
+func TestUpstreamAddress(t *testing.T) {
+	router, err := NewRouter([]Route{
+		{Name: "http", Host: "a.example.com", Upstream: "http://backend"},
+		{Name: "https", Host: "b.example.com", Upstream: "https://backend/api"},
+		{Name: "port", Upstream: "backend:8080"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"http": "backend:80", "https": "backend:443", "port": "backend:8080"}
+	for _, route := range router.routes {
+		if address := upstreamAddress(route); address != expected[route.Name] {
+			t.Errorf("Expected %s for route %s, got %s", expected[route.Name], route.Name, address)
+		}
+	}
+}
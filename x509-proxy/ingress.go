@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+// IngressPassthrough accepts the client certificate of a request from a header set by an ingress controller
+// that terminated TLS, such as nginx's ssl-client-cert. The header is only read from trusted source addresses,
+// and the certificate is verified like in a TLS handshake before it is used.
+type IngressPassthrough struct {
+	// Header carrying the client certificate, removed from every request
+	Header string
+	// Encoding of the header, one of the CertEncoding constants
+	Encoding string
+	// Trusted are the addresses of the ingress controllers
+	Trusted []netip.Prefix
+	// Roots returns the CA pool client certificates for a request host must chain to
+	Roots func(host string) *x509.CertPool
+	// VerifyConnection runs the checks of the TLS handshake, when not nil
+	VerifyConnection func(tls.ConnectionState) error
+}
+
+// Handler passes the certificate of requests from a trusted ingress to next as if the client presented it
+// in the TLS handshake. It replaces the certificate the ingress itself presented in the handshake, if any.
+// Trust is decided by the address at the other end of the connection, not by the one a PROXY header names.
+func (p *IngressPassthrough) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(p.Header)
+		r.Header.Del(p.Header)
+		if r.TLS == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if peer := peerAddr(r); !containsAddr(p.Trusted, peer) {
+			if value != "" {
+				log.Printf("%sRemoved ingress certificate header %s from untrusted %s%s", colorRed, p.Header, peer, colorReset)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The ingress's own certificate is not the client's, without the header the request has none
+		if value == "" {
+			state := *r.TLS
+			state.PeerCertificates, state.VerifiedChains = nil, nil
+			r = r.WithContext(r.Context())
+			r.TLS = &state
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		state, err := p.verify(r, value)
+		if err != nil {
+			log.Printf("%sRejected ingress client certificate from %s: %v%s", colorRed, r.RemoteAddr, err, colorReset)
+			writeErrorPage(w, http.StatusForbidden, "The client certificate is not valid.")
+			return
+		}
+		if info := requestInfoFrom(r.Context()); info != nil {
+			info.Certificate = state.PeerCertificates[0]
+		}
+
+		// The connection state is shared by the requests of the connection, so each gets its own copy
+		r = r.WithContext(r.Context())
+		r.TLS = state
+		next.ServeHTTP(w, r)
+	})
+}
+
+// verify decodes the certificate in the header and verifies it like the TLS handshake would,
+// returning the request's connection state with the certificate and its verified chains
+func (p *IngressPassthrough) verify(r *http.Request, value string) (*tls.ConnectionState, error) {
+	certs, err := DecodeCertificates(value, p.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	chains, err := verifyClientCertificate(certs, p.Roots(host))
+	if err != nil {
+		return nil, err
+	}
+
+	state := *r.TLS
+	state.PeerCertificates = certs
+	state.VerifiedChains = chains
+	if p.VerifyConnection != nil {
+		if err := p.VerifyConnection(state); err != nil {
+			return nil, err
+		}
+	}
+	return &state, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"x509-proxy/x509toolkit"
+)
+
+// ingressRequest is a request from remoteAddr carrying a client certificate in the ingress header
+func ingressRequest(t *testing.T, remoteAddr string, certs ...*x509.Certificate) *http.Request {
+	req := httptest.NewRequest("GET", "https://pwck8s.example.com/api/v1/user", nil)
+	req.RemoteAddr = remoteAddr
+	req.TLS = &tls.ConnectionState{ServerName: "pwck8s.example.com"}
+	if len(certs) > 0 {
+		value, err := EncodeCertificates(certs, CertEncodingURLPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("ssl-client-cert", value)
+	}
+	return req
+}
+
+func TestIngressPassthrough(t *testing.T) {
+	ca, caKey, err := x509toolkit.GenerateCACertificate("users-ca", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, otherKey, err := x509toolkit.GenerateCACertificate("other-ca", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	client, _ := issueCertificate(t, ca, caKey, "jane", x509.ExtKeyUsageClientAuth)
+	stranger, _ := issueCertificate(t, other, otherKey, "mallory", x509.ExtKeyUsageClientAuth)
+	server, _ := issueCertificate(t, ca, caKey, "server", x509.ExtKeyUsageServerAuth)
+	banned, _ := issueCertificate(t, ca, caKey, "banned", x509.ExtKeyUsageClientAuth)
+
+	trusted, err := ParseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := 0
+	ingress := &IngressPassthrough{
+		Header:   "ssl-client-cert",
+		Encoding: CertEncodingURLPEM,
+		Trusted:  trusted,
+		Roots:    func(string) *x509.CertPool { return roots },
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if state.VerifiedChains[0][0].Subject.CommonName == "banned" {
+				return errors.New("certificate revoked")
+			}
+			verified++
+			return nil
+		},
+	}
+
+	var seen *http.Request
+	handler := ingress.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+	}))
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		seen = nil
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A certificate from the ingress is verified and used as if the client presented it
+	req := ingressRequest(t, "10.1.2.3:41234", client, ca)
+	serve(req)
+	if seen == nil || len(seen.TLS.PeerCertificates) == 0 || seen.TLS.PeerCertificates[0].Subject.CommonName != "jane" {
+		t.Fatal("Expected the ingress certificate to be passed on")
+	}
+	if len(seen.TLS.VerifiedChains) == 0 || seen.TLS.VerifiedChains[0][len(seen.TLS.VerifiedChains[0])-1].Subject.CommonName != "users-ca" {
+		t.Error("Expected the chain verified against the CA")
+	}
+	if seen.Header.Get("ssl-client-cert") != "" {
+		t.Error("Expected the ingress header not to be forwarded")
+	}
+	if req.TLS.PeerCertificates != nil {
+		t.Error("Expected the connection state of the connection to be left alone")
+	}
+	if verified != 1 {
+		t.Errorf("Expected the connection checks to run once, ran %d times", verified)
+	}
+
+	// Anyone else can not pass a certificate they do not hold the key of
+	serve(ingressRequest(t, "192.0.2.1:41234", client))
+	if seen == nil || len(seen.TLS.PeerCertificates) != 0 || seen.Header.Get("ssl-client-cert") != "" {
+		t.Error("Expected the header of an untrusted source to be removed and ignored")
+	}
+
+	// The ingress's own certificate from the handshake is replaced by the one it passes on
+	req = ingressRequest(t, "10.1.2.3:41234", client)
+	req.TLS.PeerCertificates = []*x509.Certificate{server}
+	serve(req)
+	if seen == nil || seen.TLS.PeerCertificates[0].Subject.CommonName != "jane" {
+		t.Error("Expected the header certificate of a trusted ingress to be used")
+	}
+
+	// Anyone else keeps the certificate of their handshake
+	req = ingressRequest(t, "192.0.2.1:41234", stranger)
+	req.TLS.PeerCertificates = []*x509.Certificate{client}
+	serve(req)
+	if seen == nil || seen.TLS.PeerCertificates[0].Subject.CommonName != "jane" || seen.Header.Get("ssl-client-cert") != "" {
+		t.Error("Expected the handshake certificate to be used")
+	}
+
+	// Trust goes by the address at the other end of the connection, not the one from a PROXY header
+	req = ingressRequest(t, "10.1.2.3:41234", client)
+	req = req.WithContext(context.WithValue(req.Context(), peerAddrKey{}, "192.0.2.1:41234"))
+	serve(req)
+	if seen == nil || len(seen.TLS.PeerCertificates) != 0 {
+		t.Error("Expected the header to be ignored when the connection comes from an untrusted address")
+	}
+
+	// No header from the ingress means no certificate, the path policy decides
+	serve(ingressRequest(t, "10.1.2.3:41234"))
+	if seen == nil || len(seen.TLS.PeerCertificates) != 0 {
+		t.Error("Expected a request without certificate to be passed on")
+	}
+
+	// Nor does the certificate the ingress presented in its own handshake stand in for the client's
+	req = ingressRequest(t, "10.1.2.3:41234")
+	req.TLS.PeerCertificates = []*x509.Certificate{server}
+	req.TLS.VerifiedChains = [][]*x509.Certificate{{server, ca}}
+	serve(req)
+	if seen == nil || len(seen.TLS.PeerCertificates) != 0 || len(seen.TLS.VerifiedChains) != 0 {
+		t.Error("Expected the ingress's own certificate to be removed from a request without header")
+	}
+	if len(req.TLS.PeerCertificates) != 1 {
+		t.Error("Expected the connection state of the connection to be left alone")
+	}
+
+	// Certificates failing verification are rejected
+	for name, cert := range map[string]*x509.Certificate{"other CA": stranger, "server usage": server, "revoked": banned} {
+		rr := serve(ingressRequest(t, "10.1.2.3:41234", cert))
+		if seen != nil || rr.Code != http.StatusForbidden {
+			t.Errorf("Expected the %s certificate to be rejected, got %d", name, rr.Code)
+		}
+	}
+	rr := httptest.NewRecorder()
+	req = ingressRequest(t, "10.1.2.3:41234")
+	req.Header.Set("ssl-client-cert", "-----BEGIN%20CERTIFICATE-----%0Anot%20a%20certificate")
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected an invalid header to be rejected, got %d", rr.Code)
+	}
+}
+
+func TestIngressPassthroughAccessLog(t *testing.T) {
+	ca, caKey, err := x509toolkit.GenerateCACertificate("users-ca", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	client, _ := issueCertificate(t, ca, caKey, "jane", x509.ExtKeyUsageClientAuth)
+	trusted, _ := ParseCIDRs([]string{"10.1.2.3"})
+	ingress := &IngressPassthrough{Header: "ssl-client-cert", Encoding: CertEncodingURLPEM, Trusted: trusted, Roots: func(string) *x509.CertPool { return roots }}
+
+	var out bytes.Buffer
+	logger, err := NewLogger(LogFormatJSON, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := AccessLog(logger, nil, ingress.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	// The ingress's own certificate is not the client's
+	ingressCert, _ := issueCertificate(t, ca, caKey, "ingress", x509.ExtKeyUsageClientAuth)
+	req := ingressRequest(t, "10.1.2.3:41234", client)
+	req.TLS.PeerCertificates = []*x509.Certificate{ingressCert}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !strings.Contains(out.String(), `"dn":"CN=jane"`) {
+		t.Errorf("Expected the ingress certificate in the access log, got %s", out.String())
+	}
+}
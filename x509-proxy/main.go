@@ -1,17 +1,30 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"dn"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
-	"net/http/httputil"
+	"net/netip"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"x509-proxy/assertion"
+	"x509-proxy/revocation"
 )
 
-const (
+// ANSI colours of the log messages, disabled unless logging logfmt to a terminal
+var (
 	colorRed    = "\033[31m"
 	colorGreen  = "\033[32m"
 	colorYellow = "\033[33m"
@@ -29,199 +42,937 @@ type GlobalConfig struct {
 	TLSCert string `json:"tls_cert"`
 	// The path to the TLS key
 	TLSKey string `json:"tls_key"`
-	// CA certificate pool to verify client certificates
-	CACert *x509.CertPool `json:"ca_cert"`
-	// Service to proxy to
+	// The path to the CA certificate bundle, reloaded when it changes
+	CACertPath string `json:"ca_cert_path"`
+	// Certificates and client CAs selected by the server name the client asks for
+	TLSHosts []TLSHost `json:"tls_hosts"`
+	// Service to proxy to when no routes are configured
 	ProxyURL string `json:"proxy_url"`
+	// Routes to the upstream services, by default a single route for every path to ProxyURL
+	Routes []Route `json:"routes"`
 	// Debug mode
 	Debug bool `json:"debug"`
+	// Format of the logs, LogFormatJSON or LogFormatLogfmt
+	LogFormat string `json:"log_format"`
+	// Port of the plain HTTP metrics server, 0 disables it
+	MetricsPort int `json:"metrics_port"`
+	// How often the certificates and CA bundle are checked for changes
+	CertReloadInterval time.Duration `json:"cert_reload_interval"`
+	// Client certificates expiring within this duration are counted in the metrics
+	ClientCertExpiryWarning time.Duration `json:"client_cert_expiry_warning"`
+	// Port of the plain HTTP liveness and readiness probes, 0 disables them
+	HealthPort int `json:"health_port"`
+	// How long the readiness probe waits for each upstream to accept a connection
+	ReadinessTimeout time.Duration `json:"readiness_timeout"`
+	// How long to keep serving after SIGTERM with a failing readiness probe, until the endpoints are updated
+	ShutdownDelay time.Duration `json:"shutdown_delay"`
+	// How long in-flight requests may take to finish before the remaining connections are closed
+	DrainPeriod time.Duration `json:"drain_period"`
+	// Header carrying the signed identity assertion
+	AssertionHeader string `json:"assertion_header"`
+	// Signer for identity assertions, nil when assertions are disabled
+	Assertion *assertion.Signer `json:"-"`
+	// Revocation checker for client certificates, nil when revocation checking is disabled
+	Revocation *revocation.Checker `json:"-"`
+	// Checks client certificates must pass on top of chain verification, nil when none are configured
+	CertPolicy *CertPolicy `json:"-"`
+	// Timeouts, header limit and TLS settings of the client facing server
+	Server ServerOptions `json:"-"`
+	// Load balancers whose connections start with a PROXY protocol header carrying the client address
+	ProxyProtocolTrusted []netip.Prefix `json:"-"`
+	// Client certificates passed through by a trusted ingress controller, nil when disabled
+	Ingress *IngressPassthrough `json:"-"`
+	// Per path client certificate policy, a certificate is required everywhere by default
+	PathPolicy PathPolicy `json:"path_policy"`
 }
 
-// LoadCACertPool loads a CA certificate from a given file and returns an x509.CertPool.
+// LoadCACertPool loads the CA certificates from a given file and returns an x509.CertPool.
 func LoadCACertPool(caCertPath string) (*x509.CertPool, error) {
 	// Read the CA certificate file
 	caCert, err := os.ReadFile(caCertPath)
 	if err != nil {
-		log.Fatalf("Failed to read CA certificate: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("failed to read CA certificate: %v", err)
 	}
 
 	// Create a new CertPool
 	caCertPool := x509.NewCertPool()
 
-	// Append the CA certificate to the pool
+	// Append the CA certificates to the pool
 	if !caCertPool.AppendCertsFromPEM(caCert) {
-		log.Fatalf("Failed to append CA certificate")
-		return nil, err
+		return nil, fmt.Errorf("failed to append CA certificate: no PEM certificates in %s", caCertPath)
 	}
 
 	return caCertPool, nil
 }
 
-func GetConfigFromEnvProduction() GlobalConfig {
-	// Get Config From ENV but fail if not found
-	port, err := strconv.Atoi(os.Getenv("PORT"))
+// LoadConfig reads the settings from the environment and the config file.
+// Every missing or invalid setting is reported at once rather than stopping at the first.
+func LoadConfig() (GlobalConfig, error) {
+	var errs []error
+
+	port, err := strconv.Atoi(getSetting("PORT"))
+	if err != nil {
+		errs = append(errs, errors.New("PORT must be set to a port number"))
+	}
+
+	// Certificates selected by SNI, TLS_CERT then serves the clients asking for none of their hosts
+	var tlsHosts []TLSHost
+	if value := getSetting("TLS_HOSTS"); value != "" {
+		if tlsHosts, err = ParseTLSHosts(value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	tlsCert := getSetting("TLS_CERT")
+	tlsKey := getSetting("TLS_KEY")
+	if len(tlsHosts) == 0 || tlsCert != "" || tlsKey != "" {
+		if tlsCert == "" {
+			errs = append(errs, errors.New("TLS_CERT must be set"))
+		}
+		if tlsKey == "" {
+			errs = append(errs, errors.New("TLS_KEY must be set"))
+		}
+	}
+
+	// CA_CERT is only optional when every certificate has its own client CA
+	caCertRequired := len(tlsHosts) == 0 || tlsCert != ""
+	for _, host := range tlsHosts {
+		caCertRequired = caCertRequired || host.CA == ""
+	}
+	// The bundle itself is loaded by the certificate reloaders
+	caCert := getSetting("CA_CERT")
+	if caCert == "" && caCertRequired {
+		errs = append(errs, errors.New("CA_CERT must be set"))
+	}
+
+	// Either a single upstream or a list of routes
+	proxyURL := getSetting("PROXY_URL")
+	var routes []Route
+	if value := getSetting("ROUTES"); value != "" {
+		if routes, err = ParseRoutes(value); err != nil {
+			errs = append(errs, err)
+		}
+	} else if proxyURL != "" {
+		routes = []Route{{Name: "default", Prefix: "/", Upstream: proxyURL}}
+	} else {
+		errs = append(errs, errors.New("PROXY_URL or ROUTES must be set"))
+	}
+
+	// Rate limits for routes that do not configure their own
+	rateLimit, err := GetRateLimitFromEnv()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid rate limit: %v", err))
+	}
+	if rateLimit != nil {
+		for i := range routes {
+			if routes[i].RateLimit == nil {
+				routes[i].RateLimit = rateLimit
+			}
+		}
+	}
+
+	// Limits of long-lived connections and streams for routes that do not configure their own
+	idleTimeout, err := durationFromEnv("STREAM_IDLE_TIMEOUT", 0)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	maxDuration, err := durationFromEnv("STREAM_MAX_DURATION", 0)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for i := range routes {
+		if routes[i].IdleTimeout == 0 {
+			routes[i].IdleTimeout = Duration(idleTimeout)
+		}
+		if routes[i].MaxDuration == 0 {
+			routes[i].MaxDuration = Duration(maxDuration)
+		}
+	}
+
+	// TLS settings for https upstreams that do not configure their own
+	if upstreamTLS := GetUpstreamTLSFromEnv(); upstreamTLS != nil {
+		for i := range routes {
+			if routes[i].TLS == nil && strings.HasPrefix(routes[i].Upstream, "https://") {
+				routes[i].TLS = upstreamTLS
+			}
+		}
+	}
+
+	debugMode := false
+	if value := getSetting("DEBUG"); value != "" {
+		if debugMode, err = strconv.ParseBool(value); err != nil {
+			errs = append(errs, errors.New("DEBUG must be true or false"))
+		}
+	}
+
+	logFormat := getSetting("LOG_FORMAT")
+	if logFormat == "" {
+		logFormat = LogFormatJSON
+	}
+	if _, err := NewLogger(logFormat, io.Discard); err != nil {
+		errs = append(errs, fmt.Errorf("invalid LOG_FORMAT: %v", err))
+		logFormat = LogFormatJSON
+	}
+
+	metricsPort := 9090
+	if value := getSetting("METRICS_PORT"); value != "" {
+		if metricsPort, err = strconv.Atoi(value); err != nil || metricsPort < 0 {
+			errs = append(errs, errors.New("METRICS_PORT must be a port number, or 0 to disable metrics"))
+		}
+	}
+
+	healthPort := 8081
+	if value := getSetting("HEALTH_PORT"); value != "" {
+		if healthPort, err = strconv.Atoi(value); err != nil || healthPort < 0 {
+			errs = append(errs, errors.New("HEALTH_PORT must be a port number, or 0 to disable the probes"))
+		}
+	}
+
+	readinessTimeout, err := durationFromEnv("READINESS_TIMEOUT", 2*time.Second)
+	if err != nil {
+		errs = append(errs, err)
+	} else if readinessTimeout <= 0 {
+		errs = append(errs, errors.New("READINESS_TIMEOUT must be positive"))
+	}
+
+	// After SIGTERM the proxy stays up for the delay, then waits up to the drain period for requests to finish
+	shutdownDelay, err := durationFromEnv("SHUTDOWN_DELAY", 5*time.Second)
 	if err != nil {
-		log.Fatal("PORT must be set")
+		errs = append(errs, err)
+	} else if shutdownDelay < 0 {
+		errs = append(errs, errors.New("SHUTDOWN_DELAY must not be negative"))
 	}
 
-	tlsCert := os.Getenv("TLS_CERT")
-	if tlsCert == "" {
-		log.Fatal("TLS_CERT must be set")
+	drainPeriod, err := durationFromEnv("DRAIN_PERIOD", 30*time.Second)
+	if err != nil {
+		errs = append(errs, err)
+	} else if drainPeriod < 0 {
+		errs = append(errs, errors.New("DRAIN_PERIOD must not be negative"))
 	}
 
-	tlsKey := os.Getenv("TLS_KEY")
-	if tlsKey == "" {
-		log.Fatal("TLS_KEY must be set")
+	reloadInterval, err := durationFromEnv("CERT_RELOAD_INTERVAL", 30*time.Second)
+	if err != nil {
+		errs = append(errs, err)
+	} else if reloadInterval <= 0 {
+		errs = append(errs, errors.New("CERT_RELOAD_INTERVAL must be positive"))
 	}
 
-	caCert := os.Getenv("CA_CERT")
-	if caCert == "" {
-		log.Fatal("CA_CERT must be set")
+	expiryWarning, err := durationFromEnv("CLIENT_CERT_EXPIRY_WARNING", 30*24*time.Hour)
+	if err != nil {
+		errs = append(errs, err)
 	}
 
-	proxyURL := os.Getenv("PROXY_URL")
-	if proxyURL == "" {
-		log.Fatal("PROXY_URL must be set")
+	assertionHeader, signer, err := GetAssertionSignerFromEnv()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid identity assertion signer: %v", err))
 	}
 
-	debug := os.Getenv("DEBUG")
-	if debug == "" {
-		debug = "false"
+	revocationChecker, err := GetRevocationCheckerFromEnv()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid revocation checker: %v", err))
 	}
-	debugMode, err := strconv.ParseBool(debug)
+
+	serverOptions, err := GetServerOptionsFromEnv()
 	if err != nil {
-		return GlobalConfig{}
+		errs = append(errs, err)
 	}
 
-	caCertPool, err := LoadCACertPool(caCert)
+	proxyProtocolTrusted, err := ParseCIDRs(splitList(getSetting("PROXY_PROTOCOL_TRUSTED_CIDRS")))
 	if err != nil {
-		log.Fatal("Error loading CA certificate pool:", err)
+		errs = append(errs, fmt.Errorf("invalid PROXY_PROTOCOL_TRUSTED_CIDRS: %v", err))
+	}
+
+	ingress, err := GetIngressPassthroughFromEnv()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	certPolicy, err := GetCertPolicyFromEnv()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid certificate policy: %v", err))
+	}
+
+	pathPolicy, err := ParsePathPolicy(getSetting("PATH_POLICY"), getSetting("PATH_POLICY_DEFAULT"))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid path policy: %v", err))
 	}
 
 	return GlobalConfig{
-		Port:     port,
-		TLSCert:  tlsCert,
-		TLSKey:   tlsKey,
-		CACert:   caCertPool,
-		ProxyURL: proxyURL,
-		Debug:    debugMode,
+		Port:                    port,
+		TLSCert:                 tlsCert,
+		TLSKey:                  tlsKey,
+		CACertPath:              caCert,
+		TLSHosts:                tlsHosts,
+		ProxyURL:                proxyURL,
+		Routes:                  routes,
+		Debug:                   debugMode,
+		LogFormat:               logFormat,
+		MetricsPort:             metricsPort,
+		CertReloadInterval:      reloadInterval,
+		ClientCertExpiryWarning: expiryWarning,
+		HealthPort:              healthPort,
+		ReadinessTimeout:        readinessTimeout,
+		ShutdownDelay:           shutdownDelay,
+		DrainPeriod:             drainPeriod,
+		AssertionHeader:         assertionHeader,
+		Assertion:               signer,
+		Revocation:              revocationChecker,
+		CertPolicy:              certPolicy,
+		Server:                  serverOptions,
+		ProxyProtocolTrusted:    proxyProtocolTrusted,
+		Ingress:                 ingress,
+		PathPolicy:              pathPolicy,
+	}, errors.Join(errs...)
+}
+
+// GetUpstreamTLSFromEnv returns the default TLS settings of https upstreams, nil when none are set
+func GetUpstreamTLSFromEnv() *UpstreamTLS {
+	upstreamTLS := UpstreamTLS{
+		CA:         getSetting("UPSTREAM_CA"),
+		ServerName: getSetting("UPSTREAM_SERVER_NAME"),
+		ClientCert: getSetting("UPSTREAM_CLIENT_CERT"),
+		ClientKey:  getSetting("UPSTREAM_CLIENT_KEY"),
+	}
+	if upstreamTLS == (UpstreamTLS{}) {
+		return nil
+	}
+	return &upstreamTLS
+}
+
+// GetRateLimitFromEnv returns the default rate limit of every route, nil when neither RATE_LIMIT nor RATE_LIMIT_IP is set
+func GetRateLimitFromEnv() (*RateLimit, error) {
+	limit := &RateLimit{
+		Key:     getSetting("RATE_LIMIT_KEY"),
+		Methods: splitList(getSetting("RATE_LIMIT_METHODS")),
+	}
+	floats := map[string]*float64{"RATE_LIMIT": &limit.Rate, "RATE_LIMIT_IP": &limit.IPRate}
+	for name, field := range floats {
+		if value := getSetting(name); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a number of requests per second: %v", name, err)
+			}
+			*field = parsed
+		}
 	}
+	ints := map[string]*int{"RATE_LIMIT_BURST": &limit.Burst, "RATE_LIMIT_IP_BURST": &limit.IPBurst, "RATE_LIMIT_MAX_KEYS": &limit.MaxKeys}
+	for name, field := range ints {
+		if value := getSetting(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an integer: %v", name, err)
+			}
+			*field = parsed
+		}
+	}
+	if limit.Rate == 0 && limit.IPRate == 0 {
+		return nil, nil
+	}
+	return limit, limit.Validate()
 }
 
-func HandleConfig() (GlobalConfig, error) {
-	//Check if Debug mode is enabled
-	debug := os.Getenv("DEBUG")
-	if debug == "" {
-		debug = "false"
+// GetAssertionSignerFromEnv returns the identity assertion header and signer.
+// Assertions are disabled, and the signer is nil, when ASSERTION_KEY is not set.
+func GetAssertionSignerFromEnv() (string, *assertion.Signer, error) {
+	header := getSetting("ASSERTION_HEADER")
+	if header == "" {
+		header = "X-Identity-Assertion"
+	}
+
+	keyPath := getSetting("ASSERTION_KEY")
+	if keyPath == "" {
+		return header, nil, nil
+	}
+
+	algorithm := getSetting("ASSERTION_ALG")
+	if algorithm == "" {
+		algorithm = "HS256"
+	}
+
+	issuer := getSetting("ASSERTION_ISSUER")
+	if issuer == "" {
+		issuer = "x509-proxy"
+	}
+
+	audience := getSetting("ASSERTION_AUDIENCE")
+	if audience == "" {
+		audience = "pwck8s"
 	}
-	debugMode, err := strconv.ParseBool(debug)
+
+	ttl, err := durationFromEnv("ASSERTION_TTL", 30*time.Second)
 	if err != nil {
-		return GlobalConfig{}, err
+		return "", nil, err
 	}
 
-	// If debug mode is enabled, use the development config
-	if debugMode {
-		// Print debug info
-		log.Println("Running in debug mode")
-		return GetConfigFromEnvProduction(), nil
+	key, err := assertion.LoadKey(algorithm, keyPath)
+	if err != nil {
+		return "", nil, err
+	}
+	signer, err := assertion.NewSigner(algorithm, key, issuer, audience, ttl)
+	if err != nil {
+		return "", nil, err
+	}
+	return header, signer, nil
+}
+
+// GetRevocationCheckerFromEnv returns the client certificate revocation checker.
+// Revocation checking is disabled, and the checker is nil, when neither CRL_FILES nor OCSP is configured.
+func GetRevocationCheckerFromEnv() (*revocation.Checker, error) {
+	crlFiles := splitList(getSetting("CRL_FILES"))
+
+	// OCSP is enabled by a responder URL, or by OCSP_ENABLED to use the responder in each certificate
+	ocspURL := getSetting("OCSP_URL")
+	ocspEnabled := ocspURL != ""
+	if value := getSetting("OCSP_ENABLED"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OCSP_ENABLED: %v", err)
+		}
+		ocspEnabled = enabled
 	}
 
-	// Otherwise, use the production config
-	log.Println("Running in production mode")
-	return GetConfigFromEnvProduction(), nil
+	if len(crlFiles) == 0 && !ocspEnabled {
+		return nil, nil
+	}
 
+	failMode := getSetting("REVOCATION_FAIL_MODE")
+	if failMode == "" {
+		failMode = "closed"
+	}
+	if failMode != "open" && failMode != "closed" {
+		return nil, fmt.Errorf("REVOCATION_FAIL_MODE must be open or closed, got %q", failMode)
+	}
+
+	refresh, err := durationFromEnv("CRL_REFRESH", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	cacheTTL, err := durationFromEnv("REVOCATION_CACHE_TTL", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	return revocation.NewChecker(crlFiles, refresh, ocspEnabled, ocspURL, failMode == "open", cacheTTL)
+}
+
+// GetServerOptionsFromEnv returns the hardening options of the client facing server, with secure defaults
+func GetServerOptionsFromEnv() (ServerOptions, error) {
+	var errs []error
+	options := ServerOptions{
+		MinVersion:   tls.VersionTLS12,
+		CipherSuites: defaultCipherSuites,
+	}
+
+	var err error
+	if value := getSetting("TLS_MIN_VERSION"); value != "" {
+		if options.MinVersion, err = ParseTLSVersion(value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid TLS_MIN_VERSION: %v", err))
+		}
+	}
+	if value := getSetting("TLS_CIPHER_SUITES"); value != "" {
+		if options.CipherSuites, err = ParseCipherSuites(splitList(value)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid TLS_CIPHER_SUITES: %v", err))
+		}
+	}
+
+	// Write and read timeouts default to none, they would cut streams, WebSocket handshakes and large uploads
+	timeouts := []struct {
+		name  string
+		field *time.Duration
+		def   time.Duration
+	}{
+		{"SERVER_READ_HEADER_TIMEOUT", &options.ReadHeaderTimeout, 10 * time.Second},
+		{"SERVER_READ_TIMEOUT", &options.ReadTimeout, 0},
+		{"SERVER_WRITE_TIMEOUT", &options.WriteTimeout, 0},
+		{"SERVER_IDLE_TIMEOUT", &options.IdleTimeout, 2 * time.Minute},
+	}
+	for _, timeout := range timeouts {
+		if *timeout.field, err = durationFromEnv(timeout.name, timeout.def); err != nil {
+			errs = append(errs, err)
+		} else if *timeout.field < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", timeout.name))
+		}
+	}
+
+	options.MaxHeaderBytes = 64 << 10
+	if value := getSetting("SERVER_MAX_HEADER_BYTES"); value != "" {
+		if options.MaxHeaderBytes, err = strconv.Atoi(value); err != nil || options.MaxHeaderBytes <= 0 {
+			errs = append(errs, errors.New("SERVER_MAX_HEADER_BYTES must be a positive number of bytes"))
+		}
+	}
+	return options, errors.Join(errs...)
+}
+
+// GetIngressPassthroughFromEnv returns the ingress certificate passthrough settings, nil when INGRESS_CERT_HEADER is not set.
+// Roots and the verify callbacks are filled in by main once the certificates are loaded.
+func GetIngressPassthroughFromEnv() (*IngressPassthrough, error) {
+	header := getSetting("INGRESS_CERT_HEADER")
+	cidrs := splitList(getSetting("INGRESS_TRUSTED_CIDRS"))
+	if header == "" {
+		if len(cidrs) > 0 {
+			return nil, errors.New("INGRESS_TRUSTED_CIDRS is set without INGRESS_CERT_HEADER")
+		}
+		return nil, nil
+	}
+
+	var errs []error
+	encoding := getSetting("INGRESS_CERT_ENCODING")
+	if encoding == "" {
+		encoding = CertEncodingURLPEM
+	}
+	if !ValidCertEncoding(encoding) {
+		errs = append(errs, fmt.Errorf("INGRESS_CERT_ENCODING must be %s, %s or %s", CertEncodingBase64PEM, CertEncodingURLPEM, CertEncodingBase64DER))
+	}
+	// Without trusted addresses anyone could send a certificate they do not hold the key of
+	trusted, err := ParseCIDRs(cidrs)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid INGRESS_TRUSTED_CIDRS: %v", err))
+	} else if len(trusted) == 0 {
+		errs = append(errs, errors.New("INGRESS_TRUSTED_CIDRS must be set with INGRESS_CERT_HEADER"))
+	}
+	// A load balancer forwards the requests of any client, trusting it for the header would trust them all.
+	// Invalid load balancer addresses are reported with the rest of the PROXY protocol settings.
+	proxyProtocolTrusted, _ := ParseCIDRs(splitList(getSetting("PROXY_PROTOCOL_TRUSTED_CIDRS")))
+	if prefixesOverlap(trusted, proxyProtocolTrusted) {
+		errs = append(errs, errors.New("INGRESS_TRUSTED_CIDRS must not overlap PROXY_PROTOCOL_TRUSTED_CIDRS, the ingress must connect directly"))
+	}
+	return &IngressPassthrough{Header: header, Encoding: encoding, Trusted: trusted}, errors.Join(errs...)
+}
+
+// GetCertPolicyFromEnv returns the client certificate policy, nil when no CERT_* check is configured
+func GetCertPolicyFromEnv() (*CertPolicy, error) {
+	var errs []error
+	policy := &CertPolicy{}
+
+	oids, err := ParsePolicyOIDs(splitList(getSetting("CERT_POLICY_OIDS")))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid CERT_POLICY_OIDS: %v", err))
+	}
+	policy.PolicyOIDs = oids
+
+	if value := getSetting("CERT_REQUIRE_CLIENT_AUTH"); value != "" {
+		if policy.RequireClientAuthEKU, err = strconv.ParseBool(value); err != nil {
+			errs = append(errs, errors.New("CERT_REQUIRE_CLIENT_AUTH must be true or false"))
+		}
+	}
+
+	ints := map[string]*int{"CERT_MIN_RSA_BITS": &policy.MinRSABits, "CERT_MIN_ECDSA_BITS": &policy.MinECDSABits}
+	for name, field := range ints {
+		if value := getSetting(name); value != "" {
+			if *field, err = strconv.Atoi(value); err != nil || *field < 0 {
+				errs = append(errs, fmt.Errorf("%s must be a number of bits", name))
+			}
+		}
+	}
+
+	if policy.MaxValidity, err = durationFromEnv("CERT_MAX_VALIDITY", 0); err != nil {
+		errs = append(errs, err)
+	}
+
+	// DNs contain commas, so the issuers are separated by semicolons
+	issuers, err := ParseIssuers(splitListBy(getSetting("CERT_ALLOWED_ISSUERS"), ";"))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid CERT_ALLOWED_ISSUERS: %v", err))
+	}
+	policy.AllowedIssuers = issuers
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if len(policy.PolicyOIDs) == 0 && !policy.RequireClientAuthEKU && policy.MinRSABits == 0 &&
+		policy.MinECDSABits == 0 && policy.MaxValidity == 0 && len(policy.AllowedIssuers) == 0 {
+		return nil, nil
+	}
+	return policy, nil
+}
+
+// durationFromEnv parses a duration setting, returning def when it is not set
+func durationFromEnv(name string, def time.Duration) (time.Duration, error) {
+	value := getSetting(name)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return d, nil
+}
+
+// HandleConfig loads the config file at path, if any, and the settings and headers it and the environment hold.
+// The error lists every problem found, the config is only usable when it is nil.
+func HandleConfig(path string) (GlobalConfig, HttpHeaderMap, error) {
+	var fileErr error
+	if path != "" {
+		fileSettings, fileErr = LoadConfigFile(path)
+	}
+	config, configErr := LoadConfig()
+	httpHeaderMap, headerErr := GetHttpHeaderMapFromEnv()
+	return config, httpHeaderMap, errors.Join(fileErr, configErr, headerErr)
 }
 
 type HttpHeaderMap struct {
 	CN string `json:"cn"`
 	DN string `json:"dn"`
+	// Header for the client's leaf certificate, empty to not forward it
+	Certificate string `json:"certificate"`
+	// Header for the rest of the verified chain, empty to not forward it
+	CertificateChain string `json:"certificate_chain"`
+	// Encoding of the certificate headers, one of the CertEncoding constants
+	CertEncoding string `json:"cert_encoding"`
+	// Fields maps header names to certificate fields, see parseCertificateField
+	Fields map[string]string `json:"fields"`
+	// Trusted headers are identity headers only the proxy may set, they are always removed from inbound requests
+	Trusted []string `json:"trusted"`
+}
+
+// defaultHeaderFields are the certificate fields forwarded when HTTP_HEADER_FIELDS is not set
+const defaultHeaderFields = "X-Client-Email=san.email,X-Client-Upn=san.upn,X-Client-Serial=serial," +
+	"X-Client-Issuer=issuer,X-Client-Fingerprint=fingerprint,X-Client-Not-After=notAfter"
+
+// IdentityHeaders returns every header the backend trusts to come from the proxy:
+// the ones the proxy sets itself and the configured trusted headers.
+func (m HttpHeaderMap) IdentityHeaders() []string {
+	var headers []string
+	own := append([]string{m.CN, m.DN, m.Certificate, m.CertificateChain}, sortedHeaders(m.Fields)...)
+	for _, header := range append(own, m.Trusted...) {
+		if header != "" {
+			headers = append(headers, header)
+		}
+	}
+	return headers
 }
 
-func GetHttpHeaderMapFromEnv() HttpHeaderMap {
+// GetHttpHeaderMapFromEnv returns the header names and certificate fields to forward, reporting every invalid setting
+func GetHttpHeaderMapFromEnv() (HttpHeaderMap, error) {
+	var errs []error
 
-	cn := os.Getenv("HTTP_HEADER_CN")
+	cn := getSetting("HTTP_HEADER_CN")
 	if cn == "" {
 		cn = "X-Client-Cn"
 	}
 
-	dn := os.Getenv("HTTP_HEADER_DN")
+	dn := getSetting("HTTP_HEADER_DN")
 	if dn == "" {
-		cn = "X-Client-Dn"
+		dn = "X-Client-Dn"
+	}
+
+	// The certificate is forwarded by default, set the variable to an empty value to disable it
+	certificate, found := lookupSetting("HTTP_HEADER_CERT")
+	if !found {
+		certificate = "X-Client-Certificate"
+	}
+
+	certEncoding := getSetting("HTTP_HEADER_CERT_ENCODING")
+	if certEncoding == "" {
+		certEncoding = CertEncodingBase64PEM
+	}
+	if !ValidCertEncoding(certEncoding) {
+		errs = append(errs, fmt.Errorf("HTTP_HEADER_CERT_ENCODING must be %s, %s or %s", CertEncodingBase64PEM, CertEncodingURLPEM, CertEncodingBase64DER))
+	}
+
+	// Set the variable to an empty value to forward no certificate fields
+	headerFields, found := lookupSetting("HTTP_HEADER_FIELDS")
+	if !found {
+		headerFields = defaultHeaderFields
+	}
+	fields, err := ParseHeaderFields(headerFields)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid HTTP_HEADER_FIELDS: %v", err))
+	}
+
+	// Identity headers pwck8s and other backends read, a client must never be able to set them.
+	// X-Client-Certificate stays removed when HTTP_HEADER_CERT moves or turns off the certificate header.
+	// Authorization is left alone, backends may authenticate bearer tokens of their own.
+	trusted := getSetting("TRUSTED_HEADERS")
+	if trusted == "" {
+		trusted = "UserDN,X-Client-Certificate"
 	}
 
 	return HttpHeaderMap{
-		CN: cn,
-		DN: dn,
+		CN:               cn,
+		DN:               dn,
+		Certificate:      certificate,
+		CertificateChain: getSetting("HTTP_HEADER_CERT_CHAIN"),
+		CertEncoding:     certEncoding,
+		Fields:           fields,
+		Trusted:          splitList(trusted),
+	}, errors.Join(errs...)
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(value string) []string {
+	return splitListBy(value, ",")
+}
+
+// splitListBy splits a list with the given separator, dropping empty entries
+func splitListBy(value string, separator string) []string {
+	var list []string
+	for _, item := range strings.Split(value, separator) {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
 	}
+	return list
 }
 
-func HandleProxy(w http.ResponseWriter, r *http.Request, config GlobalConfig, proxy *httputil.ReverseProxy, httpHeaderMap HttpHeaderMap) {
+func HandleProxy(w http.ResponseWriter, r *http.Request, config GlobalConfig, proxy http.Handler, httpHeaderMap HttpHeaderMap) {
+
+	// Never forward identity headers or an assertion the client made up, only the ones we set below
+	stripIdentityHeaders(r, append(httpHeaderMap.IdentityHeaders(), config.AssertionHeader))
 
-	// Print the incoming request's headers
-	// Log the details of the request
-	log.Printf("%sRemote Address: %s%s - %sProtocol: %s%s - %sMethod: %s%s - %sURL: %s%s",
-		colorCyan, r.RemoteAddr, colorReset,
-		colorGreen, r.Proto, colorReset,
-		colorYellow, r.Method, colorReset,
-		colorPurple, r.URL, colorReset)
+	// The path policy and the router decide on the same cleaned path, so /api/../static/ can not pass
+	// the policy of /static/ and reach the route of /api/
+	if cleaned := cleanPath(r.URL.Path); cleaned != r.URL.Path {
+		cleanedURL := *r.URL
+		cleanedURL.Path, cleanedURL.RawPath = cleaned, ""
+		r = r.WithContext(r.Context())
+		r.URL = &cleanedURL
+	}
+
+	// Enforce the client certificate mode of the path
+	hasCertificate := r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+	switch config.PathPolicy.Mode(r.URL.Path) {
+	case CertRequired:
+		if !hasCertificate {
+			log.Printf("%sRejected request without client certificate from %s for %s%s", colorRed, r.RemoteAddr, r.URL.Path, colorReset)
+			writeErrorPage(w, http.StatusUnauthorized, "A valid client certificate is required to access this page.")
+			return
+		}
+	case CertForbidden:
+		if hasCertificate {
+			log.Printf("%sRejected request with client certificate from %s for %s%s", colorRed, r.RemoteAddr, r.URL.Path, colorReset)
+			writeErrorPage(w, http.StatusForbidden, "This page must be accessed without a client certificate.")
+			return
+		}
+	}
 
 	// Check if the request has TLS and a client certificate
-	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+	if hasCertificate {
 
 		cert := r.TLS.PeerCertificates[0]
 		commonName := cert.Subject.CommonName
 
-		// Construct the DN from the certificate DN = CN,OU's,O
-		dn := cert.Subject.CommonName
-		for _, ou := range cert.Subject.OrganizationalUnit {
-			dn = dn + "," + ou
+		// Construct the canonical RFC 4514 DN, the same identity key pwck8s uses
+		userDN := dn.FromCertificate(cert).String()
+
+		// Set the headers
+		r.Header.Set(httpHeaderMap.CN, sanitizeHeaderValue(commonName))
+		r.Header.Set(httpHeaderMap.DN, sanitizeHeaderValue(userDN))
+
+		// Set the configured certificate fields
+		fieldHeaders, err := CertificateHeaders(cert, httpHeaderMap.Fields)
+		if err != nil {
+			log.Printf("%sError reading client certificate fields: %v%s", colorRed, err, colorReset)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
 		}
-		for _, o := range cert.Subject.Organization {
-			dn = dn + "," + o
+		for header, value := range fieldHeaders {
+			r.Header.Set(header, value)
 		}
 
-		// Set the headers
-		r.Header.Set(httpHeaderMap.CN, commonName)
-		r.Header.Set(httpHeaderMap.DN, string(dn))
+		// Forward the leaf certificate, and optionally the rest of the verified chain
+		if httpHeaderMap.Certificate != "" {
+			value, err := EncodeCertificates([]*x509.Certificate{cert}, httpHeaderMap.CertEncoding)
+			if err != nil {
+				log.Printf("%sError encoding client certificate: %v%s", colorRed, err, colorReset)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			r.Header.Set(httpHeaderMap.Certificate, value)
+		}
+		if httpHeaderMap.CertificateChain != "" && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 1 {
+			value, err := EncodeCertificates(r.TLS.VerifiedChains[0][1:], httpHeaderMap.CertEncoding)
+			if err != nil {
+				log.Printf("%sError encoding client certificate chain: %v%s", colorRed, err, colorReset)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			r.Header.Set(httpHeaderMap.CertificateChain, value)
+		}
+
+		// Sign the identity so the backend can trust it came from us
+		if config.Assertion != nil {
+			token, err := config.Assertion.Sign(assertion.Identity{
+				DN:     userDN,
+				CN:     commonName,
+				Serial: cert.SerialNumber.Text(16),
+			})
+			if err != nil {
+				log.Printf("%sError signing identity assertion: %v%s", colorRed, err, colorReset)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			r.Header.Set(config.AssertionHeader, token)
+		}
 	}
 	// Forward the request to the proxy
 	proxy.ServeHTTP(w, r)
 }
 
+// stripIdentityHeaders deletes the given headers from the request.
+// A client sending one of them is trying to impersonate someone, so it is logged with its real subject.
+func stripIdentityHeaders(r *http.Request, headers []string) {
+	subject := "no client certificate"
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		subject = dn.FromCertificate(r.TLS.PeerCertificates[0]).String()
+	}
+	for _, header := range headers {
+		if header == "" {
+			continue
+		}
+		if _, found := r.Header[http.CanonicalHeaderKey(header)]; found {
+			// Never log the value, it may be a credential such as a bearer token
+			log.Printf("%sRemoved client supplied identity header %s from %s (subject: %s)%s",
+				colorRed, header, r.RemoteAddr, subject, colorReset)
+			r.Header.Del(header)
+		}
+	}
+}
+
 func main() {
+	configPath := flag.String("config", os.Getenv(ConfigFileEnv), "JSON config file, environment variables override its settings")
+	checkConfig := flag.Bool("check-config", false, "validate the configuration and exit")
+	flag.Parse()
+
+	// Get the config and the HttpHeaderMap
+	config, httpHeaderMap, err := HandleConfig(*configPath)
+
+	// Report every problem at once and exit, without starting anything
+	if *checkConfig {
+		err = errors.Join(err, CheckConfig(config))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Configuration is valid")
+		return
+	}
+
+	// Structured logs, the standard logger writes through the same handler unless logfmt goes to a terminal
+	logger, _ := NewLogger(config.LogFormat, os.Stderr)
+	useLogger(logger, config.LogFormat == LogFormatLogfmt && isTerminal(os.Stderr))
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if config.Debug {
+		log.Println("Running in debug mode")
+	} else {
+		log.Println("Running in production mode")
+	}
 
-	// Get the config
-	config, err := HandleConfig()
+	// Route each request to its upstream
+	router, err := NewRouter(config.Routes)
+	if err != nil {
+		log.Fatal("Invalid routes: ", err)
+	}
+
+	// Load the server certificates and client CA bundles, and keep them up to date
+	certificates, err := NewServerCertificates(config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	certificates.Watch(config.CertReloadInterval, nil)
+	router.Watch(config.CertReloadInterval, nil)
+
+	// The base TLS config, GetConfigForClient fills in the certificate and client CA pool of the
+	// server name the client asks for at each handshake
+	tlsConfig := &tls.Config{
+		ClientAuth:     config.PathPolicy.ClientAuth(),
+		GetCertificate: certificates.GetCertificate,
+	}
 
-	// Get the HttpHeaderMap
-	httpHeaderMap := GetHttpHeaderMapFromEnv()
+	// Metrics are served in plain HTTP on their own port, so scraping needs no client certificate
+	proxyMetrics := NewProxyMetrics(certificates.Certificate, config.ClientCertExpiryWarning)
+	router.Instrument(proxyMetrics)
 
-	// Create the proxy as before
-	proxy := &httputil.ReverseProxy{
-		Director: func(req *http.Request) {
-			// req.URL.Scheme = "http"
-			req.URL.Host = config.ProxyURL
-		},
+	// Check the client certificate policy, then revocation, then record the certificates of the connections that pass
+	var verifiers []func(tls.ConnectionState) error
+	if config.CertPolicy != nil {
+		verifiers = append(verifiers, config.CertPolicy.VerifyConnection)
+	}
+	if config.Revocation != nil {
+		verifiers = append(verifiers, config.Revocation.VerifyConnection)
+		go config.Revocation.Watch(nil)
+	}
+	tlsConfig.VerifyConnection = chainVerifiers(append(verifiers, proxyMetrics.VerifyConnection)...)
+	tlsConfig.GetConfigForClient = LogTLSConnections(logger, certificates.GetConfigForClient(tlsConfig))
+
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleProxy(w, r, config, router, httpHeaderMap)
+	})
+
+	// The ingress need not present a client certificate in its handshake, the certificate it passes on is
+	// verified with the same checks and the path policy rejects requests without one
+	if config.Ingress != nil {
+		config.Ingress.Roots = certificates.ClientCAs
+		config.Ingress.VerifyConnection = tlsConfig.VerifyConnection
+		handler = config.Ingress.Handler(handler)
+		if tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	if config.MetricsPort != 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", proxyMetrics.Registry.Handler())
+		go func() {
+			log.Printf("%sStarting metrics server on port %d%s\n", colorGreen, config.MetricsPort, colorReset)
+			metricsServer := &http.Server{Addr: ":" + strconv.Itoa(config.MetricsPort), Handler: mux, ReadHeaderTimeout: config.Server.ReadHeaderTimeout}
+			log.Fatal(metricsServer.ListenAndServe())
+		}()
 	}
 
 	// Update the server to use HandleProxy
 	server := &http.Server{
-		Addr: ":" + strconv.Itoa(config.Port),
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			HandleProxy(w, r, config, proxy, httpHeaderMap)
-		}),
-		TLSConfig: &tls.Config{
-			ClientCAs:  config.CACert,
-			ClientAuth: tls.RequireAndVerifyClientCert,
-		},
+		Addr:      ":" + strconv.Itoa(config.Port),
+		Handler:   AccessLog(logger, proxyMetrics, certificates.CheckHost(handler)),
+		TLSConfig: tlsConfig,
+		ConnState: proxyMetrics.ConnState,
+		ErrorLog:  proxyMetrics.ErrorLog(),
+		// The ingress passthrough trusts the load balancer's address, not the client's from the PROXY header
+		ConnContext: PeerAddrContext,
+	}
+	config.Server.Apply(server)
+
+	// Liveness and readiness probes in plain HTTP on their own port
+	health := NewHealth(router, config.ReadinessTimeout)
+	if config.HealthPort != 0 {
+		go func() {
+			log.Printf("%sStarting health server on port %d%s\n", colorGreen, config.HealthPort, colorReset)
+			healthServer := &http.Server{Addr: ":" + strconv.Itoa(config.HealthPort), Handler: health.Handler(), ReadHeaderTimeout: config.Server.ReadHeaderTimeout}
+			log.Fatal(healthServer.ListenAndServe())
+		}()
 	}
 
-	// Start the server
-	log.Printf("%sStarting server on port %d%s\n", colorGreen, config.Port, colorReset)
-	log.Fatal(fmt.Sprintf("%sServer stopped with error: %s%s", colorRed, server.ListenAndServeTLS(config.TLSCert, config.TLSKey), colorReset))
-
+	// Start the server, the certificates come from the reloaders
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(config.ProxyProtocolTrusted) > 0 {
+		listener = &ProxyProtocolListener{Listener: listener, Trusted: config.ProxyProtocolTrusted, Timeout: config.Server.ReadHeaderTimeout}
+	}
+	go func() {
+		log.Printf("%sStarting server on port %d%s\n", colorGreen, config.Port, colorReset)
+		if err := server.ServeTLS(listener, "", ""); err != http.ErrServerClosed {
+			log.Fatal(fmt.Sprintf("%sServer stopped with error: %s%s", colorRed, err, colorReset))
+		}
+	}()
+
+	// On SIGTERM fail readiness so no new requests are sent here, then let the in-flight ones finish
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	log.Printf("%sReceived %s, shutting down in %s%s", colorYellow, sig, config.ShutdownDelay, colorReset)
+	health.Drain()
+	time.Sleep(config.ShutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainPeriod)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("%sConnections still open after the drain period of %s, closing them: %v%s", colorRed, config.DrainPeriod, err, colorReset)
+		server.Close()
+	}
+	log.Printf("%sServer stopped%s", colorGreen, colorReset)
 }
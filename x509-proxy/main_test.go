@@ -5,10 +5,14 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"math/big"
 	"net/http/httptest"
 	"net/http/httputil"
 	"os"
+	"strings"
 	"testing"
+	"time"
+	"x509-proxy/assertion"
 	"x509-proxy/x509toolkit"
 )
 
@@ -52,12 +56,53 @@ func TestHandleProxy(t *testing.T) {
 		t.Errorf("Expected CN header to be %s, got %s", cert.Subject.CommonName, req.Header.Get(httpHeaderMap.CN))
 	}
 
-	expectedDN := "test,testOU,testO"
+	expectedDN := "CN=test,OU=testOU,O=testO"
 	if req.Header.Get(httpHeaderMap.DN) != expectedDN {
 		t.Errorf("Expected DN header to be %s, got %s", expectedDN, req.Header.Get(httpHeaderMap.DN))
 	}
 }
-func TestGetConfigFromEnvProduction(t *testing.T) {
+func TestHandleProxyAssertion(t *testing.T) {
+	proxy := &httputil.ReverseProxy{}
+	httpHeaderMap := HttpHeaderMap{
+		CN: "CN",
+		DN: "DN",
+	}
+
+	// Create a GlobalConfig with an HS256 assertion signer
+	signer, err := assertion.NewSigner("HS256", []byte("0123456789abcdef0123456789abcdef"), "x509-proxy", "pwck8s", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := GlobalConfig{
+		AssertionHeader: "X-Identity-Assertion",
+		Assertion:       signer,
+	}
+
+	// A request without a certificate must not keep a client supplied assertion
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("X-Identity-Assertion", "forged")
+	HandleProxy(httptest.NewRecorder(), req, config, proxy, httpHeaderMap)
+	if req.Header.Get("X-Identity-Assertion") != "" {
+		t.Errorf("Expected client supplied assertion to be removed, got %s", req.Header.Get("X-Identity-Assertion"))
+	}
+
+	// A request with a certificate gets a freshly signed assertion
+	req = httptest.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("X-Identity-Assertion", "forged")
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{
+			SerialNumber: big.NewInt(31),
+			Subject:      pkix.Name{CommonName: "test"},
+		}},
+	}
+	HandleProxy(httptest.NewRecorder(), req, config, proxy, httpHeaderMap)
+	token := req.Header.Get("X-Identity-Assertion")
+	if token == "forged" || strings.Count(token, ".") != 2 {
+		t.Errorf("Expected a signed assertion, got %s", token)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
 	// Set up test environment variables
 	os.Setenv("PORT", "8080")
 	os.Setenv("TLS_CERT", "test-cert")
@@ -80,7 +125,10 @@ func TestGetConfigFromEnvProduction(t *testing.T) {
 	}
 
 	// Call the function
-	config := GetConfigFromEnvProduction()
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Check the returned values
 	if config.Port != 8080 {
@@ -109,3 +157,68 @@ func TestGetConfigFromEnvProduction(t *testing.T) {
 	// Clean up test CA certificate
 	os.Remove("test-ca-cert")
 }
+
+func TestHandleProxyStripsIdentityHeaders(t *testing.T) {
+	httpHeaderMap := HttpHeaderMap{
+		CN:      "X-Client-Cn",
+		DN:      "X-Client-Dn",
+		Trusted: []string{"UserDN", "Authorization"},
+	}
+
+	// A client without a certificate can not set any identity header
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("UserDN", "CN=admin")
+	req.Header.Set("X-Client-Dn", "CN=admin")
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("X-Identity-Assertion", "forged")
+	req.Header.Set("Accept", "application/json")
+
+	HandleProxy(httptest.NewRecorder(), req, GlobalConfig{AssertionHeader: "X-Identity-Assertion"}, &httputil.ReverseProxy{}, httpHeaderMap)
+
+	for _, header := range []string{"UserDN", "X-Client-Dn", "Authorization", "X-Identity-Assertion"} {
+		if value := req.Header.Get(header); value != "" {
+			t.Errorf("Expected %s to be removed, got %s", header, value)
+		}
+	}
+	if req.Header.Get("Accept") != "application/json" {
+		t.Error("Expected other headers to be kept")
+	}
+
+	// With a certificate the spoofed value is replaced by the real one
+	req = httptest.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("X-Client-Dn", "CN=admin")
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "test"}}},
+	}
+
+	HandleProxy(httptest.NewRecorder(), req, GlobalConfig{}, &httputil.ReverseProxy{}, httpHeaderMap)
+
+	if values := req.Header.Values("X-Client-Dn"); len(values) != 1 || values[0] != "CN=test" {
+		t.Errorf("Expected only the real DN, got %v", values)
+	}
+}
+
+func TestGetHttpHeaderMapFromEnvDefaults(t *testing.T) {
+	for _, name := range []string{"HTTP_HEADER_CN", "HTTP_HEADER_DN", "HTTP_HEADER_FIELDS", "TRUSTED_HEADERS"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+
+	httpHeaderMap, err := GetHttpHeaderMapFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if httpHeaderMap.CN != "X-Client-Cn" {
+		t.Errorf("Expected CN header X-Client-Cn, got %s", httpHeaderMap.CN)
+	}
+	if httpHeaderMap.DN != "X-Client-Dn" {
+		t.Errorf("Expected DN header X-Client-Dn, got %s", httpHeaderMap.DN)
+	}
+	if httpHeaderMap.Fields["X-Client-Email"] != "san.email" {
+		t.Errorf("Expected the default email field, got %v", httpHeaderMap.Fields)
+	}
+	// Backends authenticating bearer tokens need the Authorization header of the client
+	if strings.Join(httpHeaderMap.Trusted, ",") != "UserDN,X-Client-Certificate" {
+		t.Errorf("Expected UserDN and X-Client-Certificate to be trusted by default, got %v", httpHeaderMap.Trusted)
+	}
+}
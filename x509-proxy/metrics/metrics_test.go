@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounterVec("requests_total", "Requests served.", "route", "status")
+	latency := registry.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	connections := registry.NewGaugeVec("connections", "Open connections.")
+	registry.NewGaugeFunc("expiry_days", "Days until expiry.", func() float64 { return 42.5 })
+
+	requests.Inc("api", "200")
+	requests.Add(2, "api", "200")
+	requests.Inc("frontend", `say "hi"`)
+	latency.Observe(0.05, "api")
+	latency.Observe(0.5, "api")
+	latency.Observe(5, "api")
+	connections.Add(2)
+	connections.Add(-1)
+
+	rr := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="api",status="200"} 3
+requests_total{route="frontend",status="say \"hi\""} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="api",le="0.1"} 1
+latency_seconds_bucket{route="api",le="1"} 2
+latency_seconds_bucket{route="api",le="+Inf"} 3
+latency_seconds_sum{route="api"} 5.55
+latency_seconds_count{route="api"} 3
+# HELP connections Open connections.
+# TYPE connections gauge
+connections 1
+# HELP expiry_days Days until expiry.
+# TYPE expiry_days gauge
+expiry_days 42.5
+`
+	if rr.Body.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, rr.Body.String())
+	}
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Expected the Prometheus text format, got %s", rr.Header().Get("Content-Type"))
+	}
+}
+
+func TestDuplicateMetric(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounterVec("requests_total", "Requests.")
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a metric twice to panic")
+		}
+	}()
+	registry.NewGaugeVec("requests_total", "Requests.")
+}
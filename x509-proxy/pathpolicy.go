@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Client certificate modes of a path
+const (
+	// CertRequired rejects requests without a verified client certificate
+	CertRequired = "required"
+	// CertOptional forwards the identity when a certificate is given, and the request without one otherwise
+	CertOptional = "optional"
+	// CertForbidden rejects requests that present a client certificate
+	CertForbidden = "forbidden"
+)
+
+// PathRule sets the client certificate mode for every path starting with Prefix
+type PathRule struct {
+	Prefix string `json:"prefix"`
+	Mode   string `json:"mode"`
+}
+
+// PathPolicy decides per path whether a client certificate is required, optional or forbidden.
+// The rule with the longest matching prefix wins, Default applies when no rule matches.
+type PathPolicy struct {
+	// Default mode, an empty value means CertRequired
+	Default string     `json:"default"`
+	Rules   []PathRule `json:"rules"`
+}
+
+// ValidCertMode reports whether mode is one of the client certificate modes
+func ValidCertMode(mode string) bool {
+	switch mode {
+	case CertRequired, CertOptional, CertForbidden:
+		return true
+	}
+	return false
+}
+
+// ParsePathPolicy parses a comma separated list of prefix=mode rules, such as "/healthcheck=optional,/api/=required"
+func ParsePathPolicy(rules string, defaultMode string) (PathPolicy, error) {
+	if defaultMode == "" {
+		defaultMode = CertRequired
+	}
+	if !ValidCertMode(defaultMode) {
+		return PathPolicy{}, fmt.Errorf("invalid default mode %q, expected %s, %s or %s", defaultMode, CertRequired, CertOptional, CertForbidden)
+	}
+
+	policy := PathPolicy{Default: defaultMode}
+	for _, rule := range splitList(rules) {
+		prefix, mode, found := strings.Cut(rule, "=")
+		prefix, mode = strings.TrimSpace(prefix), strings.TrimSpace(mode)
+		if !found || !strings.HasPrefix(prefix, "/") {
+			return PathPolicy{}, fmt.Errorf("invalid path rule %q, expected /prefix=mode", rule)
+		}
+		if !ValidCertMode(mode) {
+			return PathPolicy{}, fmt.Errorf("invalid mode %q for %s, expected %s, %s or %s", mode, prefix, CertRequired, CertOptional, CertForbidden)
+		}
+		policy.Rules = append(policy.Rules, PathRule{Prefix: prefix, Mode: mode})
+	}
+
+	// Longest prefix first so the most specific rule matches
+	sort.SliceStable(policy.Rules, func(i, j int) bool {
+		return len(policy.Rules[i].Prefix) > len(policy.Rules[j].Prefix)
+	})
+	return policy, nil
+}
+
+// cleanPath resolves the dot segments and repeated slashes of a request path, keeping a trailing slash
+func cleanPath(requestPath string) string {
+	cleaned := path.Clean("/" + requestPath)
+	if strings.HasSuffix(requestPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// Mode returns the client certificate mode for a request path.
+// The path is cleaned first so /healthcheck/../api/ can not borrow the mode of /healthcheck.
+func (p PathPolicy) Mode(requestPath string) string {
+	cleaned := cleanPath(requestPath)
+	for _, rule := range p.Rules {
+		if strings.HasPrefix(cleaned, rule.Prefix) {
+			return rule.Mode
+		}
+	}
+	if p.Default == "" {
+		return CertRequired
+	}
+	return p.Default
+}
+
+// ClientAuth returns the TLS client authentication the policy needs.
+// A certificate is only demanded during the handshake when every path requires one,
+// otherwise the handshake verifies a certificate if given and HandleProxy enforces the policy.
+func (p PathPolicy) ClientAuth() tls.ClientAuthType {
+	if p.Default != "" && p.Default != CertRequired {
+		return tls.VerifyClientCertIfGiven
+	}
+	for _, rule := range p.Rules {
+		if rule.Mode != CertRequired {
+			return tls.VerifyClientCertIfGiven
+		}
+	}
+	return tls.RequireAndVerifyClientCert
+}
+
+// errorPage is served when a request does not meet the path policy
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+</body>
+</html>
+`))
+
+// writeErrorPage writes a small HTML error page with the given status
+func writeErrorPage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err := errorPage.Execute(w, struct {
+		Status  int
+		Title   string
+		Message string
+	}{status, http.StatusText(status), message})
+	if err != nil {
+		log.Printf("%sError writing error page: %v%s", colorRed, err, colorReset)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+)
+
+func TestPathPolicyMode(t *testing.T) {
+	policy, err := ParsePathPolicy("/healthcheck=optional, /static/=optional, /api/=required, /api/public/=forbidden", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"/healthcheck":              CertOptional,
+		"/static/app.js":            CertOptional,
+		"/api/users":                CertRequired,
+		"/api/public/info":          CertForbidden,
+		"/":                         CertRequired,
+		"/healthcheck/../api/users": CertRequired,
+		"/static/../api/":           CertRequired,
+	}
+	for path, expected := range tests {
+		if mode := policy.Mode(path); mode != expected {
+			t.Errorf("Expected %s to be %s, got %s", path, expected, mode)
+		}
+	}
+
+	if policy.ClientAuth() != tls.VerifyClientCertIfGiven {
+		t.Error("Expected optional paths to only verify a certificate if given")
+	}
+	if (PathPolicy{}).ClientAuth() != tls.RequireAndVerifyClientCert {
+		t.Error("Expected the default policy to require a certificate during the handshake")
+	}
+}
+
+func TestParsePathPolicyInvalid(t *testing.T) {
+	if _, err := ParsePathPolicy("healthcheck=optional", ""); err == nil {
+		t.Error("Expected a prefix without a leading slash to be rejected")
+	}
+	if _, err := ParsePathPolicy("/healthcheck=open", ""); err == nil {
+		t.Error("Expected an unknown mode to be rejected")
+	}
+	if _, err := ParsePathPolicy("", "sometimes"); err == nil {
+		t.Error("Expected an unknown default mode to be rejected")
+	}
+}
+
+func TestHandleProxyPathPolicy(t *testing.T) {
+	policy, err := ParsePathPolicy("/healthcheck=optional,/public/=forbidden", CertRequired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := GlobalConfig{PathPolicy: policy}
+	httpHeaderMap := HttpHeaderMap{CN: "X-Client-Cn", DN: "X-Client-Dn"}
+
+	// The backend answers every request that gets through
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	proxy := &httputil.ReverseProxy{Director: func(*http.Request) {}, Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		rr := httptest.NewRecorder()
+		backend.ServeHTTP(rr, r)
+		return rr.Result(), nil
+	})}
+	withCertificate := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "test"}}},
+	}
+
+	tests := []struct {
+		path     string
+		tls      *tls.ConnectionState
+		expected int
+	}{
+		{"/api/users", nil, http.StatusUnauthorized},
+		{"/api/users", withCertificate, http.StatusNoContent},
+		{"/healthcheck", nil, http.StatusNoContent},
+		{"/healthcheck", withCertificate, http.StatusNoContent},
+		{"/public/index.html", nil, http.StatusNoContent},
+		{"/public/index.html", withCertificate, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com"+test.path, nil)
+		req.TLS = test.tls
+		rr := httptest.NewRecorder()
+
+		HandleProxy(rr, req, config, proxy, httpHeaderMap)
+
+		if rr.Code != test.expected {
+			t.Errorf("Expected %d for %s (certificate: %t), got %d", test.expected, test.path, test.tls != nil, rr.Code)
+		}
+		if rr.Code == http.StatusUnauthorized && !strings.Contains(rr.Body.String(), "client certificate is required") {
+			t.Errorf("Expected the 401 page, got %s", rr.Body.String())
+		}
+	}
+}
+
+func TestHandleProxyCleansPath(t *testing.T) {
+	policy, err := ParsePathPolicy("/static/=optional", CertRequired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter([]Route{
+		{Name: "api", Prefix: "/api/", Upstream: echoUpstream(t, "api").URL},
+		{Name: "frontend", Prefix: "/", Upstream: echoUpstream(t, "frontend").URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := GlobalConfig{PathPolicy: policy}
+	httpHeaderMap := HttpHeaderMap{CN: "X-Client-Cn", DN: "X-Client-Dn"}
+
+	// The policy and the route are both decided on the cleaned path
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/api/../static/app.js", "frontend /static/app.js"},
+		{"/api//..//static/", "frontend /static/"},
+		{"/static/../api/users", "A valid client certificate is required"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com"+test.path, nil)
+		req.TLS = &tls.ConnectionState{}
+		rr := httptest.NewRecorder()
+		HandleProxy(rr, req, config, router, httpHeaderMap)
+		if !strings.Contains(rr.Body.String(), test.expected) {
+			t.Errorf("Expected %s to get %q, got %d %q", test.path, test.expected, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+// roundTripperFunc turns a function into an http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"x509-proxy/metrics"
+)
+
+// clientCertRetention is how long a client certificate counts after it was last seen
+const clientCertRetention = 24 * time.Hour
+
+// maxTrackedClientCerts bounds the memory used to count expiring client certificates
+const maxTrackedClientCerts = 10000
+
+// ProxyMetrics are the metrics x509-proxy exposes on its metrics port
+type ProxyMetrics struct {
+	Registry *metrics.Registry
+
+	handshakeFailures *metrics.CounterVec
+	requests          *metrics.CounterVec
+	upstreamDuration  *metrics.HistogramVec
+	connections       *metrics.GaugeVec
+	rateLimited       *metrics.CounterVec
+	rateLimitKeys     *metrics.GaugeVec
+
+	// Client certificates seen recently, by fingerprint
+	expiryWarning time.Duration
+	mu            sync.Mutex
+	clientCerts   map[string]seenCertificate
+}
+
+// seenCertificate is the expiry of a client certificate and when it was last presented
+type seenCertificate struct {
+	notAfter time.Time
+	lastSeen time.Time
+}
+
+// NewProxyMetrics registers the proxy metrics. serverCert returns the certificate currently served,
+// client certificates expiring within expiryWarning are counted as close to expiring.
+func NewProxyMetrics(serverCert func() *tls.Certificate, expiryWarning time.Duration) *ProxyMetrics {
+	registry := metrics.NewRegistry()
+	m := &ProxyMetrics{
+		Registry: registry,
+		handshakeFailures: registry.NewCounterVec("x509_proxy_tls_handshake_failures_total",
+			"TLS handshakes that failed, by reason.", "reason"),
+		requests: registry.NewCounterVec("x509_proxy_requests_total",
+			"Requests served, by route and status code.", "route", "status"),
+		upstreamDuration: registry.NewHistogramVec("x509_proxy_upstream_duration_seconds",
+			"Time until the upstream sent the response headers, by route.", nil, "route"),
+		connections: registry.NewGaugeVec("x509_proxy_active_connections",
+			"Client connections currently open."),
+		rateLimited: registry.NewCounterVec("x509_proxy_rate_limited_total",
+			"Requests rejected with 429, by route and the limit hit (dn, serial or ip).", "route", "limit"),
+		rateLimitKeys: registry.NewGaugeVec("x509_proxy_rate_limit_keys",
+			"Token buckets kept in memory, by route and limiter (identity or ip).", "route", "limiter"),
+		expiryWarning: expiryWarning,
+		clientCerts:   make(map[string]seenCertificate),
+	}
+	m.connections.Set(0)
+
+	registry.NewGaugeFunc("x509_proxy_server_certificate_expiry_days",
+		"Days until the served certificate expires.", func() float64 {
+			cert := serverCert()
+			if cert == nil || cert.Leaf == nil {
+				return math.NaN()
+			}
+			return time.Until(cert.Leaf.NotAfter).Hours() / 24
+		})
+	registry.NewGaugeFunc("x509_proxy_client_certificates_expiring",
+		"Distinct client certificates presented in the last 24 hours that expire within "+expiryWarning.String()+".",
+		func() float64 { return float64(m.expiringClientCerts()) })
+	return m
+}
+
+// ObserveRequest counts a served request, route is empty for requests rejected before routing
+func (m *ProxyMetrics) ObserveRequest(route string, status int) {
+	if route == "" {
+		route = "none"
+	}
+	m.requests.Inc(route, strconv.Itoa(status))
+}
+
+// ConnState is the http.Server.ConnState callback counting open connections
+func (m *ProxyMetrics) ConnState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		m.connections.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		m.connections.Add(-1)
+	}
+}
+
+// VerifyConnection is a tls.Config.VerifyConnection callback recording client certificate expiry
+func (m *ProxyMetrics) VerifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fingerprint := Fingerprint(cert)
+	if _, found := m.clientCerts[fingerprint]; !found && len(m.clientCerts) >= maxTrackedClientCerts {
+		m.pruneClientCerts(now)
+		if len(m.clientCerts) >= maxTrackedClientCerts {
+			return nil
+		}
+	}
+	m.clientCerts[fingerprint] = seenCertificate{notAfter: cert.NotAfter, lastSeen: now}
+	return nil
+}
+
+// expiringClientCerts counts the recently seen client certificates that expire soon
+func (m *ProxyMetrics) expiringClientCerts() int {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneClientCerts(now)
+	count := 0
+	for _, seen := range m.clientCerts {
+		if seen.notAfter.Sub(now) < m.expiryWarning {
+			count++
+		}
+	}
+	return count
+}
+
+// pruneClientCerts forgets certificates not seen for clientCertRetention, the caller must hold the lock
+func (m *ProxyMetrics) pruneClientCerts(now time.Time) {
+	for fingerprint, seen := range m.clientCerts {
+		if now.Sub(seen.lastSeen) > clientCertRetention {
+			delete(m.clientCerts, fingerprint)
+		}
+	}
+}
+
+// ErrorLog returns the http.Server.ErrorLog, counting TLS handshake failures before logging them
+func (m *ProxyMetrics) ErrorLog() *log.Logger {
+	return log.New(errorLogWriter{m}, "", 0)
+}
+
+// errorLogWriter counts handshake errors reported by net/http and passes every line to the standard logger
+type errorLogWriter struct {
+	m *ProxyMetrics
+}
+
+func (w errorLogWriter) Write(p []byte) (int, error) {
+	line := string(bytes.TrimSpace(p))
+	if _, rest, found := strings.Cut(line, "TLS handshake error from "); found {
+		// The address is followed by ": " and the error
+		if _, reason, found := strings.Cut(rest, ": "); found {
+			w.m.handshakeFailures.Inc(HandshakeFailureReason(reason))
+		}
+	}
+	log.Print(line)
+	return len(p), nil
+}
+
+// HandshakeFailureReason classifies a TLS handshake error into a short label value
+func HandshakeFailureReason(err string) string {
+	switch {
+	case strings.Contains(err, "proxy protocol:"):
+		return "proxy_protocol"
+	case strings.Contains(err, "didn't provide a certificate"):
+		return "no_client_certificate"
+	case strings.Contains(err, "unknown authority"):
+		return "unknown_authority"
+	case strings.Contains(err, "expired or is not yet valid"):
+		return "certificate_expired"
+	case strings.Contains(err, "certificate revoked"):
+		return "certificate_revoked"
+	case strings.Contains(err, "revocation status"):
+		return "revocation_unknown"
+	case strings.Contains(err, "certificate policy violation"):
+		return "certificate_policy"
+	case strings.Contains(err, "incompatible key usage"):
+		return "key_usage"
+	case strings.Contains(err, "bad certificate"), strings.Contains(err, "x509:"):
+		return "bad_certificate"
+	case strings.Contains(err, "does not look like a TLS handshake"):
+		return "not_tls"
+	case strings.Contains(err, "protocol version"), strings.Contains(err, "no cipher suite"), strings.Contains(err, "unsupported"):
+		return "protocol"
+	case strings.Contains(err, "timeout"):
+		return "timeout"
+	case strings.Contains(err, "EOF"), strings.Contains(err, "connection reset"):
+		return "connection_closed"
+	}
+	return "other"
+}
+
+// instrumentedTransport records how long the upstream of a route takes to answer
+type instrumentedTransport struct {
+	route string
+	next  http.RoundTripper
+	m     *ProxyMetrics
+}
+
+func (t instrumentedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	t.m.upstreamDuration.Observe(time.Since(start).Seconds(), t.route)
+	return resp, err
+}
+
+// ObserveRateLimiters records the number of buckets the limiters of a route keep
+func (m *ProxyMetrics) ObserveRateLimiters(route *Route) {
+	if route.limiters.identity != nil {
+		m.rateLimitKeys.Set(float64(route.limiters.identity.Len()), route.Name, "identity")
+	}
+	if route.limiters.ip != nil {
+		m.rateLimitKeys.Set(float64(route.limiters.ip.Len()), route.Name, "ip")
+	}
+}
+
+// Instrument records the upstream latency and rate limiting of every route in m
+func (rt *Router) Instrument(m *ProxyMetrics) {
+	for _, route := range rt.routes {
+		route.metrics = m
+		next := route.proxy.Transport
+		if next == nil {
+			next = http.DefaultTransport
+		}
+		route.proxy.Transport = instrumentedTransport{route: route.Name, next: next, m: m}
+	}
+}
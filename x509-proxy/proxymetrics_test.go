@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"x509-proxy/x509toolkit"
+)
+
+// scrape returns the metrics text
+func scrape(t *testing.T, m *ProxyMetrics) string {
+	rr := httptest.NewRecorder()
+	m.Registry.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	return rr.Body.String()
+}
+
+func TestProxyMetricsHandshakeFailures(t *testing.T) {
+	ca, caKey, err := x509toolkit.GenerateCACertificate("test", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, serverKey := issueCertificate(t, ca, caKey, "localhost", x509.ExtKeyUsageServerAuth)
+	pair := tls.Certificate{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey, Leaf: serverCert}
+	m := NewProxyMetrics(func() *tls.Certificate { return &pair }, 30*24*time.Hour)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{
+		Certificates:     []tls.Certificate{pair},
+		ClientCAs:        x509.NewCertPool(),
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		VerifyConnection: m.VerifyConnection,
+	}
+	server.Config.ErrorLog = m.ErrorLog()
+	server.Config.ConnState = m.ConnState
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	// A client without a certificate, and one with a certificate from an unknown CA
+	other, otherKey, err := x509toolkit.GenerateCACertificate("other", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, clientKey := issueCertificate(t, other, otherKey, "client", x509.ExtKeyUsageClientAuth)
+	for _, certificates := range [][]tls.Certificate{nil, {{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey}}} {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: certificates}}}
+		if resp, err := client.Get(server.URL); err == nil {
+			resp.Body.Close()
+		}
+		client.CloseIdleConnections()
+	}
+
+	// The server logs the failures asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		text := scrape(t, m)
+		if strings.Contains(text, `x509_proxy_tls_handshake_failures_total{reason="no_client_certificate"} 1`) &&
+			strings.Contains(text, `x509_proxy_tls_handshake_failures_total{reason="unknown_authority"} 1`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected handshake failures by reason, got:\n%s", text)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	text := scrape(t, m)
+	if !strings.Contains(text, "x509_proxy_server_certificate_expiry_days 0.04") {
+		t.Errorf("Expected the server certificate to expire in about an hour, got:\n%s", text)
+	}
+}
+
+func TestProxyMetricsClientCertificates(t *testing.T) {
+	m := NewProxyMetrics(func() *tls.Certificate { return nil }, 7*24*time.Hour)
+
+	ca, caKey, err := x509toolkit.GenerateCACertificate("test", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// issueCertificate certificates expire in an hour, the CA in a year
+	expiring, _ := issueCertificate(t, ca, caKey, "client", x509.ExtKeyUsageClientAuth)
+	for _, cert := range []*x509.Certificate{expiring, expiring, ca} {
+		m.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	}
+	m.ObserveRequest("api", http.StatusOK)
+	m.ObserveRequest("", http.StatusUnauthorized)
+
+	text := scrape(t, m)
+	for _, line := range []string{
+		"x509_proxy_client_certificates_expiring 1",
+		`x509_proxy_requests_total{route="api",status="200"} 1`,
+		`x509_proxy_requests_total{route="none",status="401"} 1`,
+		"x509_proxy_active_connections 0",
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("Expected %q in:\n%s", line, text)
+		}
+	}
+	// Without a server certificate the expiry is not exposed
+	if strings.Contains(text, "\nx509_proxy_server_certificate_expiry_days ") {
+		t.Errorf("Expected no server certificate expiry, got:\n%s", text)
+	}
+}
+
+func TestHandshakeFailureReason(t *testing.T) {
+	tests := map[string]string{
+		"tls: client didn't provide a certificate":                                                           "no_client_certificate",
+		"tls: failed to verify certificate: x509: certificate signed by unknown authority":                   "unknown_authority",
+		"tls: failed to verify certificate: x509: certificate has expired or is not yet valid: current time": "certificate_expired",
+		"certificate revoked: serial 2 listed in CRL /crl/ca.crl":                                            "certificate_revoked",
+		"tls: first record does not look like a TLS handshake":                                               "not_tls",
+		"EOF":                                 "connection_closed",
+		"read tcp 10.0.0.1:8443: i/o timeout": "timeout",
+		"tls: client offered only unsupported versions: [302 301]":            "protocol",
+		"proxy protocol: reading header: read tcp 10.0.0.1:8443: i/o timeout": "proxy_protocol",
+		"something else": "other",
+	}
+	for err, expected := range tests {
+		if reason := HandshakeFailureReason(err); reason != expected {
+			t.Errorf("Expected %q to be %s, got %s", err, expected, reason)
+		}
+	}
+}
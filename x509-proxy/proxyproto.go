@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength is the longest PROXY protocol v1 header, including the CRLF
+const proxyV1MaxLength = 107
+
+// ParseCIDRs parses addresses in CIDR notation such as 10.0.0.0/8, a single address is a prefix of its own
+func ParseCIDRs(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	var errs []error
+	for _, value := range values {
+		if addr, err := netip.ParseAddr(value); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid CIDR %q", value))
+			continue
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, errors.Join(errs...)
+}
+
+// containsAddr reports whether the IP of a host:port address is in one of the prefixes
+func containsAddr(prefixes []netip.Prefix, address string) bool {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return false
+	}
+	ip := addrPort.Addr().Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixesOverlap reports whether any prefix of a shares an address with one of b
+func prefixesOverlap(a, b []netip.Prefix) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x.Overlaps(y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ProxyProtocolListener accepts connections that start with a PROXY protocol v1 or v2 header from
+// trusted load balancers, so RemoteAddr is the address of the client instead of the load balancer.
+// Connections from other addresses are used as they are, a PROXY header they send fails the TLS handshake.
+type ProxyProtocolListener struct {
+	net.Listener
+	// Trusted are the addresses of the load balancers, which must send a header
+	Trusted []netip.Prefix
+	// Timeout bounds reading the header, zero means no limit
+	Timeout time.Duration
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || !containsAddr(l.Trusted, conn.RemoteAddr().String()) {
+		return conn, err
+	}
+	// The header is read by the connection's own goroutine, so a slow load balancer does not block Accept
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.Timeout}, nil
+}
+
+// proxyConn is a connection from a trusted load balancer, whose PROXY header is read on first use
+type proxyConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// readHeader reads the PROXY header once, before any data or the remote address is used
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.remote, c.err = readProxyHeader(c.reader)
+		if c.err != nil {
+			c.err = fmt.Errorf("proxy protocol: %w", c.err)
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the header, or the load balancer's for a header without one
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// peerAddrKey is the context key of the address at the other end of a request's TCP connection
+type peerAddrKey struct{}
+
+// PeerAddrContext is an http.Server ConnContext keeping the address at the other end of the TCP connection,
+// which is the load balancer for a connection with a PROXY header while RemoteAddr is the client it names.
+// The server calls it in its accept loop, so it must not wait for the PROXY header.
+func PeerAddrContext(ctx context.Context, conn net.Conn) context.Context {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if proxied, ok := conn.(*proxyConn); ok {
+		conn = proxied.Conn
+	}
+	return context.WithValue(ctx, peerAddrKey{}, conn.RemoteAddr().String())
+}
+
+// peerAddr returns the address at the other end of the request's TCP connection, RemoteAddr when unknown
+func peerAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(peerAddrKey{}).(string); ok {
+		return addr
+	}
+	return r.RemoteAddr
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header and returns the source address it carries,
+// nil for health checks of the load balancer itself and for unknown address families
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyHeaderV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyHeaderV1(r)
+	}
+	return nil, errors.New("missing header")
+}
+
+// readProxyHeaderV1 reads a text header such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading header: %w", err)
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port %q", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyHeaderV2 reads a binary header, its TLVs are skipped
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", versionCommand>>4)
+	}
+
+	switch versionCommand & 0x0f {
+	case 0x0:
+		// LOCAL: a connection of the load balancer itself, such as a health check
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", versionCommand&0x0f)
+	}
+
+	// Only TCP over IPv4 and IPv6 carry an address we can use
+	var size int
+	switch family {
+	case 0x11:
+		size = 4
+	case 0x21:
+		size = 16
+	default:
+		return nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, errors.New("v2 header too short for its addresses")
+	}
+	ip, _ := netip.AddrFromSlice(payload[:size])
+	port := binary.BigEndian.Uint16(payload[2*size:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a PROXY protocol v2 header for a TCP connection from src to dst
+func proxyV2Header(command byte, src netip.AddrPort, dst netip.AddrPort) []byte {
+	family := byte(0x11)
+	if src.Addr().Is6() {
+		family = 0x21
+	}
+	var payload []byte
+	payload = append(payload, src.Addr().AsSlice()...)
+	payload = append(payload, dst.Addr().AsSlice()...)
+	payload = binary.BigEndian.AppendUint16(payload, src.Port())
+	payload = binary.BigEndian.AppendUint16(payload, dst.Port())
+	// A TLV the reader must skip
+	payload = append(payload, 0x04, 0x00, 0x01, 0x00)
+
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src := netip.MustParseAddrPort("203.0.113.7:51234")
+	dst := netip.MustParseAddrPort("198.51.100.1:443")
+	src6 := netip.MustParseAddrPort("[2001:db8::7]:51234")
+	dst6 := netip.MustParseAddrPort("[2001:db8::1]:443")
+
+	for _, test := range []struct {
+		name     string
+		header   []byte
+		expected string
+		err      string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 198.51.100.1 51234 443\r\n"), "203.0.113.7:51234", ""},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51234 443\r\n"), "[2001:db8::7]:51234", ""},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", ""},
+		{"v2 tcp4", proxyV2Header(0x1, src, dst), "203.0.113.7:51234", ""},
+		{"v2 tcp6", proxyV2Header(0x1, src6, dst6), "[2001:db8::7]:51234", ""},
+		{"v2 local", proxyV2Header(0x0, src, dst), "", ""},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::7 2001:db8::1 51234 443\r\n"), "", "invalid v1 source address"},
+		{"v1 bad port", []byte("PROXY TCP4 203.0.113.7 198.51.100.1 99999 443\r\n"), "", "invalid v1 source port"},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), "", "too long"},
+		{"v2 truncated", proxyV2Header(0x1, src, dst)[:15], "", "reading header"},
+		{"v2 command", proxyV2Header(0x7, src, dst), "", "unsupported command"},
+		{"no header", []byte("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\x00"), "", "missing header"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(test.header), strings.NewReader("GET / HTTP/1.1\r\n")))
+			addr, err := readProxyHeader(r)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (addr == nil && test.expected != "") || (addr != nil && addr.String() != test.expected) {
+				t.Errorf("Expected address %q, got %v", test.expected, addr)
+			}
+			// The data after the header is left for the TLS handshake
+			if rest, _ := io.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("Expected the request to follow the header, got %q", rest)
+			}
+		})
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	prefixes, err := ParseCIDRs([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "172.16.5.4/12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32", "172.16.0.0/12"} {
+		if prefixes[i].String() != expected {
+			t.Errorf("Expected %s, got %s", expected, prefixes[i])
+		}
+	}
+	if _, err := ParseCIDRs([]string{"10.0.0.0/33", "load-balancer"}); err == nil || !strings.Contains(err.Error(), "load-balancer") {
+		t.Errorf("Expected every invalid CIDR to be reported, got %v", err)
+	}
+}
+
+// serveRemoteAddr serves the remote address of each request behind a PROXY protocol listener
+func serveRemoteAddr(t *testing.T, trusted string) string {
+	return serveAddr(t, trusted, func(r *http.Request) string { return r.RemoteAddr })
+}
+
+// serveAddr serves the address addr returns for each request behind a PROXY protocol listener trusting trusted
+func serveAddr(t *testing.T, trusted string, addr func(r *http.Request) string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefixes, err := ParseCIDRs([]string{trusted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, addr(r))
+	}), ConnContext: PeerAddrContext}
+	go server.Serve(&ProxyProtocolListener{Listener: listener, Trusted: prefixes, Timeout: time.Second})
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+// requestRemoteAddr sends header then a request, returning the remote address the server saw
+func requestRemoteAddr(t *testing.T, address string, header string) (string, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, header+"GET / HTTP/1.1\r\nHost: proxy\r\nConnection: close\r\n\r\n"); err != nil {
+		return "", err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	return string(body), err
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	// The load balancer is trusted, the client address comes from its header
+	address := serveRemoteAddr(t, "127.0.0.0/8")
+	remoteAddr, err := requestRemoteAddr(t, address, "PROXY TCP4 203.0.113.7 198.51.100.1 51234 443\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remoteAddr != "203.0.113.7:51234" {
+		t.Errorf("Expected the client address from the header, got %s", remoteAddr)
+	}
+
+	// A health check of the load balancer keeps its own address
+	remoteAddr, err = requestRemoteAddr(t, address, "PROXY UNKNOWN\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(remoteAddr, "127.0.0.1:") {
+		t.Errorf("Expected the load balancer address, got %s", remoteAddr)
+	}
+
+	// A trusted source must send a header
+	if _, err := requestRemoteAddr(t, address, ""); err == nil {
+		t.Error("Expected a connection without header from a trusted source to be closed")
+	}
+
+	// Anyone else can not set the address
+	address = serveRemoteAddr(t, "10.0.0.0/8")
+	if _, err := requestRemoteAddr(t, address, "PROXY TCP4 203.0.113.7 198.51.100.1 51234 443\r\n"); err == nil {
+		t.Error("Expected a header from an untrusted source to be rejected")
+	}
+	remoteAddr, err = requestRemoteAddr(t, address, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(remoteAddr, "127.0.0.1:") {
+		t.Errorf("Expected the connection address, got %s", remoteAddr)
+	}
+}
+
+func TestPeerAddrContext(t *testing.T) {
+	// The peer of a connection with a PROXY header is the load balancer
+	address := serveAddr(t, "127.0.0.0/8", peerAddr)
+	peer, err := requestRemoteAddr(t, address, "PROXY TCP4 203.0.113.7 198.51.100.1 51234 443\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(peer, "127.0.0.1:") {
+		t.Errorf("Expected the load balancer address, got %s", peer)
+	}
+
+	address = serveAddr(t, "10.0.0.0/8", peerAddr)
+	peer, err = requestRemoteAddr(t, address, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(peer, "127.0.0.1:") {
+		t.Errorf("Expected the connection address, got %s", peer)
+	}
+
+	// A load balancer that sends nothing does not hold up the connections accepted after it
+	address = serveAddr(t, "127.0.0.0/8", peerAddr)
+	silent, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	start := time.Now()
+	if _, err := requestRemoteAddr(t, address, "PROXY TCP4 203.0.113.7 198.51.100.1 51234 443\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the connection not to wait for the silent one, took %s", elapsed)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"container/list"
+	"dn"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limit keys of the identity limiter
+const (
+	RateLimitKeyDN     = "dn"
+	RateLimitKeySerial = "serial"
+)
+
+// defaultMaxRateLimitKeys bounds the number of buckets a limiter keeps
+const defaultMaxRateLimitKeys = 10000
+
+// RateLimit configures the token buckets of a route
+type RateLimit struct {
+	// Rate is the sustained requests per second of each client identity, 0 for no identity limit
+	Rate float64 `json:"rate"`
+	// Burst is how many requests an identity may make at once, at least 1
+	Burst int `json:"burst"`
+	// Key identifies a client by certificate "dn" (default) or "serial".
+	// Requests without a certificate are limited by IP address instead.
+	Key string `json:"key"`
+	// IPRate and IPBurst limit each client IP address on top of the identity limit, 0 for no IP limit
+	IPRate  float64 `json:"ip_rate"`
+	IPBurst int     `json:"ip_burst"`
+	// Methods limits only these methods, such as POST, every method when empty
+	Methods []string `json:"methods"`
+	// MaxKeys bounds the buckets kept per limiter, the least recently used are dropped first
+	MaxKeys int `json:"max_keys"`
+}
+
+// Validate checks the settings and fills in defaults
+func (l *RateLimit) Validate() error {
+	if l.Rate < 0 || l.IPRate < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	if l.Rate == 0 && l.IPRate == 0 {
+		return fmt.Errorf("rate or ip_rate must be set")
+	}
+	if l.Key == "" {
+		l.Key = RateLimitKeyDN
+	}
+	if l.Key != RateLimitKeyDN && l.Key != RateLimitKeySerial {
+		return fmt.Errorf("rate limit key must be %s or %s, got %q", RateLimitKeyDN, RateLimitKeySerial, l.Key)
+	}
+	if l.Burst < 1 {
+		l.Burst = int(math.Max(1, math.Ceil(l.Rate)))
+	}
+	if l.IPBurst < 1 {
+		l.IPBurst = int(math.Max(1, math.Ceil(l.IPRate)))
+	}
+	if l.MaxKeys <= 0 {
+		l.MaxKeys = defaultMaxRateLimitKeys
+	}
+	for i, method := range l.Methods {
+		l.Methods[i] = strings.ToUpper(method)
+	}
+	return nil
+}
+
+// appliesTo reports whether requests with the given method are limited
+func (l *RateLimit) appliesTo(method string) bool {
+	if len(l.Methods) == 0 {
+		return true
+	}
+	for _, m := range l.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// bucket is the token bucket of one key
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a set of token buckets by key, bounded to maxKeys with least recently used eviction.
+// Dropping an idle bucket only forgets a full bucket, so eviction never lets a client burst more
+// than a new client could.
+type Limiter struct {
+	rate    float64
+	burst   float64
+	maxKeys int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+// NewLimiter returns a limiter refilling rate tokens per second up to burst for each key
+func NewLimiter(rate float64, burst int, maxKeys int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		maxKeys: maxKeys,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Allow takes a token for key. When none is left it returns false and how long until one is.
+func (l *Limiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var b *bucket
+	if element, found := l.buckets[key]; found {
+		b = element.Value.(*bucket)
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+		l.lru.MoveToFront(element)
+	} else {
+		for l.lru.Len() >= l.maxKeys {
+			oldest := l.lru.Back()
+			delete(l.buckets, oldest.Value.(*bucket).key)
+			l.lru.Remove(oldest)
+		}
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// Len returns the number of buckets kept
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lru.Len()
+}
+
+// routeLimiters are the limiters of a route
+type routeLimiters struct {
+	config   *RateLimit
+	identity *Limiter
+	ip       *Limiter
+}
+
+func newRouteLimiters(config *RateLimit) *routeLimiters {
+	limiters := &routeLimiters{config: config}
+	if config.Rate > 0 {
+		limiters.identity = NewLimiter(config.Rate, config.Burst, config.MaxKeys)
+	}
+	if config.IPRate > 0 {
+		limiters.ip = NewLimiter(config.IPRate, config.IPBurst, config.MaxKeys)
+	}
+	return limiters
+}
+
+// allow checks the request against the IP and identity limits.
+// When it is throttled it returns the limit that was hit and how long to wait.
+func (l *routeLimiters) allow(r *http.Request, now time.Time) (bool, string, time.Duration) {
+	if !l.config.appliesTo(r.Method) {
+		return true, "", 0
+	}
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	if l.ip != nil {
+		if ok, wait := l.ip.Allow(ip, now); !ok {
+			return false, "ip", wait
+		}
+	}
+	if l.identity != nil {
+		key := "ip:" + ip
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			cert := r.TLS.PeerCertificates[0]
+			key = "dn:" + dn.FromCertificate(cert).Key()
+			if l.config.Key == RateLimitKeySerial && cert.SerialNumber != nil {
+				// The issuer keeps serials of different CAs apart
+				key = "serial:" + string(cert.RawIssuer) + "/" + cert.SerialNumber.Text(16)
+			}
+		}
+		if ok, wait := l.identity.Allow(key, now); !ok {
+			return false, l.config.Key, wait
+		}
+	}
+	return true, "", 0
+}
+
+// writeTooManyRequests answers a throttled request with 429 and when to retry, in whole seconds
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeErrorPage(w, http.StatusTooManyRequests, "Too many requests, please slow down and try again later.")
+}
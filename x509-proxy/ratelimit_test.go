@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(2, 3, 10)
+	now := time.Now()
+
+	// The burst is available at once, then one token every 500ms
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Allow("a", now); !ok {
+			t.Fatalf("Expected request %d of the burst to be allowed", i+1)
+		}
+	}
+	ok, wait := limiter.Allow("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms, got %t %s", ok, wait)
+	}
+	if ok, _ := limiter.Allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("Expected a refilled token to be allowed")
+	}
+
+	// Other keys have their own bucket
+	if ok, _ := limiter.Allow("b", now); !ok {
+		t.Error("Expected another key to be allowed")
+	}
+}
+
+func TestLimiterBounded(t *testing.T) {
+	limiter := NewLimiter(1, 1, 2)
+	now := time.Now()
+	limiter.Allow("a", now)
+	limiter.Allow("b", now)
+	limiter.Allow("a", now)
+	limiter.Allow("c", now)
+
+	if limiter.Len() != 2 {
+		t.Errorf("Expected 2 buckets, got %d", limiter.Len())
+	}
+	// b was the least recently used and has been dropped, a is still throttled
+	if ok, _ := limiter.Allow("a", now); ok {
+		t.Error("Expected the recently used bucket to be kept")
+	}
+}
+
+func TestRouteRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	router, err := NewRouter([]Route{{
+		Name:      "api",
+		Upstream:  upstream.URL,
+		RateLimit: &RateLimit{Rate: 1, Burst: 2, IPRate: 1, IPBurst: 3, Methods: []string{"post"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewProxyMetrics(func() *tls.Certificate { return nil }, time.Hour)
+	router.Instrument(m)
+
+	request := func(method string, cn string, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com/api/users", nil)
+		req.RemoteAddr = remoteAddr
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}, SerialNumber: big.NewInt(1)}},
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Each identity gets its burst of 2
+	for i := 0; i < 2; i++ {
+		if rr := request("POST", "alice", "10.0.0.1:1234"); rr.Code != http.StatusOK {
+			t.Fatalf("Expected request %d to be allowed, got %d", i+1, rr.Code)
+		}
+	}
+	rr := request("POST", "alice", "10.0.0.1:1234")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After 1, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	// Only POST is limited
+	if rr := request("GET", "alice", "10.0.0.1:1234"); rr.Code != http.StatusOK {
+		t.Errorf("Expected GET to be allowed, got %d", rr.Code)
+	}
+
+	// The IP limit applies to every identity behind the address, its burst of 3 is used up
+	if rr := request("POST", "bob", "10.0.0.1:5678"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the IP limit to apply, got %d", rr.Code)
+	}
+	if rr := request("POST", "bob", "10.0.0.2:5678"); rr.Code != http.StatusOK {
+		t.Errorf("Expected another IP to be allowed, got %d", rr.Code)
+	}
+
+	text := scrape(t, m)
+	for _, line := range []string{
+		`x509_proxy_rate_limited_total{route="api",limit="dn"} 1`,
+		`x509_proxy_rate_limited_total{route="api",limit="ip"} 1`,
+		`x509_proxy_rate_limit_keys{route="api",limiter="identity"} 2`,
+		`x509_proxy_rate_limit_keys{route="api",limiter="ip"} 2`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("Expected %q in:\n%s", line, text)
+		}
+	}
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	for _, limit := range []RateLimit{{}, {Rate: -1}, {Rate: 1, Key: "cn"}} {
+		if err := limit.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", limit)
+		}
+	}
+	limit := RateLimit{Rate: 0.5}
+	if err := limit.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if limit.Burst != 1 || limit.Key != RateLimitKeyDN || limit.MaxKeys != defaultMaxRateLimitKeys {
+		t.Errorf("Expected defaults to be filled in, got %+v", limit)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CertReloader serves the current server certificate and client CA pool.
+// The files are polled and swapped in atomically when their content changes, so a rotated
+// cert-manager certificate or a new CA is picked up without restarting the proxy.
+type CertReloader struct {
+	certPath string
+	keyPath  string
+	caPath   string
+
+	cert   atomic.Pointer[tls.Certificate]
+	caPool atomic.Pointer[x509.CertPool]
+
+	// mu serializes reloads, the content of the last loaded files detects changes
+	mu        sync.Mutex
+	certBytes []byte
+	keyBytes  []byte
+	caBytes   []byte
+}
+
+// NewCertReloader loads the certificate and CA bundle, failing if either is invalid.
+// caPath may be empty for a certificate without a CA bundle, such as an upstream client certificate.
+func NewCertReloader(certPath string, keyPath string, caPath string) (*CertReloader, error) {
+	c := &CertReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+		caPath:   caPath,
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the files again and swaps in whatever changed.
+// On error the previously loaded certificate and pool stay in use.
+func (c *CertReloader) Reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	certBytes, err := os.ReadFile(c.certPath)
+	if err != nil {
+		return fmt.Errorf("failed to read TLS certificate: %v", err)
+	}
+	keyBytes, err := os.ReadFile(c.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read TLS key: %v", err)
+	}
+	var caBytes []byte
+	if c.caPath != "" {
+		caBytes, err = os.ReadFile(c.caPath)
+		if err != nil {
+			return fmt.Errorf("failed to read CA certificate: %v", err)
+		}
+	}
+
+	if !bytes.Equal(certBytes, c.certBytes) || !bytes.Equal(keyBytes, c.keyBytes) {
+		cert, err := tls.X509KeyPair(certBytes, keyBytes)
+		if err != nil {
+			// The certificate and key are often written one after the other, try again next time
+			return fmt.Errorf("failed to load TLS key pair: %v", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse TLS certificate: %v", err)
+		}
+		cert.Leaf = leaf
+
+		c.cert.Store(&cert)
+		c.certBytes, c.keyBytes = certBytes, keyBytes
+		log.Printf("%sLoaded certificate %s: subject=%s fingerprint=%s notAfter=%s%s",
+			colorGreen, c.certPath, leaf.Subject.String(), Fingerprint(leaf), leaf.NotAfter.UTC().Format(time.RFC3339), colorReset)
+	}
+
+	if c.caPath != "" && !bytes.Equal(caBytes, c.caBytes) {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return fmt.Errorf("failed to append CA certificate: no PEM certificates in %s", c.caPath)
+		}
+
+		c.caPool.Store(pool)
+		c.caBytes = caBytes
+		for _, ca := range parsePEMCertificates(caBytes) {
+			log.Printf("%sLoaded client CA %s: subject=%s fingerprint=%s notAfter=%s%s",
+				colorGreen, c.caPath, ca.Subject.String(), Fingerprint(ca), ca.NotAfter.UTC().Format(time.RFC3339), colorReset)
+		}
+	}
+	return nil
+}
+
+// Watch reloads the files every interval until stop is closed
+func (c *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := c.Reload(); err != nil {
+				log.Printf("%sError reloading certificates, keeping previous ones: %v%s", colorRed, err, colorReset)
+			}
+		}
+	}
+}
+
+// Certificate returns the current server certificate
+func (c *CertReloader) Certificate() *tls.Certificate {
+	return c.cert.Load()
+}
+
+// CAPool returns the current client CA pool, nil without a CA bundle
+func (c *CertReloader) CAPool() *x509.CertPool {
+	return c.caPool.Load()
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate as hex
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// parsePEMCertificates returns every certificate in a PEM bundle, skipping anything it can not parse
+func parsePEMCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
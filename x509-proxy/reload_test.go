@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"x509-proxy/x509toolkit"
+)
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "tls.crt")
+	keyPath := filepath.Join(dir, "tls.key")
+	caPath := filepath.Join(dir, "ca.crt")
+
+	// The server certificate doubles as the client CA to keep the test short
+	first, firstKey, err := x509toolkit.GenerateCACertificate("first", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKeyPair(t, first, firstKey, certPath, keyPath)
+	writeKeyPair(t, first, firstKey, caPath, filepath.Join(dir, "ca.key"))
+
+	reloader, err := NewCertReloader(certPath, keyPath, caPath)
+	if err != nil {
+		t.Fatalf("Failed to create reloader: %v", err)
+	}
+	cert, _ := reloader.GetCertificate(nil)
+	if Fingerprint(cert.Leaf) != Fingerprint(first) {
+		t.Errorf("Expected the first certificate to be served")
+	}
+
+	// Rotate the certificate and add a second CA to the bundle
+	second, secondKey, err := x509toolkit.GenerateCACertificate("second", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKeyPair(t, second, secondKey, certPath, keyPath)
+	bundle := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: first.Raw}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: second.Raw})...)
+	if err := os.WriteFile(caPath, bundle, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	cert, _ = reloader.GetCertificate(nil)
+	if Fingerprint(cert.Leaf) != Fingerprint(second) {
+		t.Errorf("Expected the rotated certificate to be served")
+	}
+
+	// The CA pool is reloaded with the certificate
+	if _, err := second.Verify(x509.VerifyOptions{Roots: reloader.CAPool()}); err != nil {
+		t.Errorf("Expected the new CA to be trusted: %v", err)
+	}
+
+	// A broken certificate is rejected and the previous one stays in use
+	if err := os.WriteFile(certPath, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Error("Expected reloading a broken certificate to fail")
+	}
+	cert, _ = reloader.GetCertificate(nil)
+	if Fingerprint(cert.Leaf) != Fingerprint(second) {
+		t.Errorf("Expected the previous certificate to still be served")
+	}
+}
@@ -0,0 +1,288 @@
+package revocation
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ErrRevoked is returned when a certificate has been revoked
+var ErrRevoked = errors.New("certificate revoked")
+
+// crl is a loaded revocation list with its revoked serial numbers indexed
+type crl struct {
+	path    string
+	list    *x509.RevocationList
+	revoked map[string]time.Time
+	// verified is set once the CRL signature has been checked against its issuer
+	verified atomic.Bool
+}
+
+// ocspResult is a cached OCSP answer
+type ocspResult struct {
+	status  int
+	expires time.Time
+}
+
+// Checker checks client certificates against CRLs and, optionally, an OCSP responder.
+// Use VerifyConnection as the tls.Config callback of the same name.
+type Checker struct {
+	// CRLFiles are PEM or DER encoded CRLs, reloaded every RefreshInterval
+	CRLFiles []string
+	// RefreshInterval is how often CRLFiles are read again
+	RefreshInterval time.Duration
+	// OCSPEnabled turns on OCSP checks
+	OCSPEnabled bool
+	// OCSPURL overrides the responder from the certificate's Authority Information Access extension
+	OCSPURL string
+	// FailOpen lets a certificate through when its status can not be determined
+	FailOpen bool
+	// CacheTTL bounds how long an OCSP answer is reused, answers are never reused past their NextUpdate
+	CacheTTL time.Duration
+	// Client used to query the OCSP responder
+	Client *http.Client
+
+	mu    sync.RWMutex
+	crls  []*crl
+	cache map[string]ocspResult
+}
+
+// NewChecker returns a Checker and loads the CRL files, failing if any of them can not be read
+func NewChecker(crlFiles []string, refreshInterval time.Duration, ocspEnabled bool, ocspURL string, failOpen bool, cacheTTL time.Duration) (*Checker, error) {
+	c := &Checker{
+		CRLFiles:        crlFiles,
+		RefreshInterval: refreshInterval,
+		OCSPEnabled:     ocspEnabled,
+		OCSPURL:         ocspURL,
+		FailOpen:        failOpen,
+		CacheTTL:        cacheTTL,
+		Client:          &http.Client{Timeout: 5 * time.Second},
+		cache:           make(map[string]ocspResult),
+	}
+	if err := c.LoadCRLs(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadCRLs reads every CRL file and replaces the loaded lists.
+// If any file can not be read the previously loaded lists are kept.
+func (c *Checker) LoadCRLs() error {
+	var crls []*crl
+	for _, path := range c.CRLFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read CRL %s: %v", path, err)
+		}
+
+		// Accept both PEM and DER encoded CRLs
+		der := data
+		if block, _ := pem.Decode(data); block != nil {
+			der = block.Bytes
+		}
+		list, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("failed to parse CRL %s: %v", path, err)
+		}
+
+		revoked := make(map[string]time.Time, len(list.RevokedCertificateEntries))
+		for _, entry := range list.RevokedCertificateEntries {
+			revoked[entry.SerialNumber.String()] = entry.RevocationTime
+		}
+		crls = append(crls, &crl{path: path, list: list, revoked: revoked})
+		log.Printf("Loaded CRL %s: %d revoked certificates, next update %s", path, len(revoked), list.NextUpdate.Format(time.RFC3339))
+	}
+
+	c.mu.Lock()
+	c.crls = crls
+	c.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the CRL files every RefreshInterval until stop is closed
+func (c *Checker) Watch(stop <-chan struct{}) {
+	if len(c.CRLFiles) == 0 || c.RefreshInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := c.LoadCRLs(); err != nil {
+				log.Printf("Error reloading CRLs, keeping previous lists: %v", err)
+			}
+		}
+	}
+}
+
+// VerifyConnection checks the leaf of every verified chain.
+// It is called after the standard chain verification, so the issuer is always known, and unlike
+// VerifyPeerCertificate also for resumed sessions, so a certificate revoked since can not resume one.
+func (c *Checker) VerifyConnection(state tls.ConnectionState) error {
+	for _, chain := range state.VerifiedChains {
+		if len(chain) < 2 {
+			continue
+		}
+		if err := c.Check(chain[0], chain[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check returns ErrRevoked if cert has been revoked by issuer.
+// If the status can not be determined it returns an error unless the Checker fails open.
+func (c *Checker) Check(cert *x509.Certificate, issuer *x509.Certificate) error {
+	var unknown []error
+
+	if len(c.CRLFiles) > 0 {
+		if err := c.checkCRL(cert, issuer); errors.Is(err, ErrRevoked) {
+			return err
+		} else if err != nil {
+			unknown = append(unknown, err)
+		}
+	}
+
+	if c.OCSPEnabled {
+		if err := c.checkOCSP(cert, issuer); errors.Is(err, ErrRevoked) {
+			return err
+		} else if err != nil {
+			unknown = append(unknown, err)
+		}
+	}
+
+	if len(unknown) == 0 {
+		return nil
+	}
+	err := fmt.Errorf("revocation status of %s unknown: %v", cert.Subject.CommonName, errors.Join(unknown...))
+	if c.FailOpen {
+		log.Printf("Allowing certificate (fail-open): %v", err)
+		return nil
+	}
+	return err
+}
+
+// checkCRL looks the certificate up in the CRL published by its issuer
+func (c *Checker) checkCRL(cert *x509.Certificate, issuer *x509.Certificate) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, list := range c.crls {
+		if !bytes.Equal(list.list.RawIssuer, cert.RawIssuer) {
+			continue
+		}
+
+		// Only trust a CRL actually signed by the certificate's issuer
+		if !list.verified.Load() {
+			if err := list.list.CheckSignatureFrom(issuer); err != nil {
+				return fmt.Errorf("CRL %s signature invalid: %v", list.path, err)
+			}
+			list.verified.Store(true)
+		}
+
+		if !list.list.NextUpdate.IsZero() && time.Now().After(list.list.NextUpdate) {
+			return fmt.Errorf("CRL %s expired at %s", list.path, list.list.NextUpdate.Format(time.RFC3339))
+		}
+
+		if revokedAt, ok := list.revoked[cert.SerialNumber.String()]; ok {
+			return fmt.Errorf("%w: serial %s listed in CRL %s since %s", ErrRevoked, cert.SerialNumber.Text(16), list.path, revokedAt.Format(time.RFC3339))
+		}
+		return nil
+	}
+	return fmt.Errorf("no CRL loaded for issuer %s", cert.Issuer.String())
+}
+
+// checkOCSP asks the OCSP responder for the certificate status, reusing cached answers
+func (c *Checker) checkOCSP(cert *x509.Certificate, issuer *x509.Certificate) error {
+	key := string(cert.RawIssuer) + "/" + cert.SerialNumber.String()
+
+	c.mu.RLock()
+	cached, ok := c.cache[key]
+	c.mu.RUnlock()
+	if !ok || time.Now().After(cached.expires) {
+		response, err := c.queryOCSP(cert, issuer)
+		if err != nil {
+			return err
+		}
+
+		// Cache until the responder says the answer is stale, capped at CacheTTL
+		expires := time.Now().Add(c.CacheTTL)
+		if !response.NextUpdate.IsZero() && response.NextUpdate.Before(expires) {
+			expires = response.NextUpdate
+		}
+		cached = ocspResult{status: response.Status, expires: expires}
+
+		c.mu.Lock()
+		c.cache[key] = cached
+		c.pruneCache()
+		c.mu.Unlock()
+	}
+
+	switch cached.status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("%w: serial %s revoked according to OCSP", ErrRevoked, cert.SerialNumber.Text(16))
+	}
+	return fmt.Errorf("OCSP responder does not know serial %s", cert.SerialNumber.Text(16))
+}
+
+// queryOCSP sends a single OCSP request for the certificate
+func (c *Checker) queryOCSP(cert *x509.Certificate, issuer *x509.Certificate) (*ocsp.Response, error) {
+	responder := c.OCSPURL
+	if responder == "" {
+		if len(cert.OCSPServer) == 0 {
+			return nil, fmt.Errorf("no OCSP responder configured or in certificate")
+		}
+		responder = cert.OCSPServer[0]
+	}
+
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCSP request: %v", err)
+	}
+
+	resp, err := c.Client.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, fmt.Errorf("OCSP request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder returned %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OCSP response: %v", err)
+	}
+	response, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCSP response: %v", err)
+	}
+	return response, nil
+}
+
+// pruneCache drops expired OCSP answers, the caller must hold the write lock
+func (c *Checker) pruneCache() {
+	now := time.Now()
+	for key, result := range c.cache {
+		if now.After(result.expires) {
+			delete(c.cache, key)
+		}
+	}
+}
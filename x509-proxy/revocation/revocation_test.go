@@ -0,0 +1,220 @@
+package revocation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+	"x509-proxy/x509toolkit"
+)
+
+// issueClientCertificate signs a client certificate with the given serial number
+func issueClientCertificate(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, serial int64) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509toolkit.SignCertificate(&x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "client"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &key.PublicKey, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writeCRL writes a PEM CRL revoking the given serial numbers and returns its path
+func writeCRL(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, nextUpdate time.Time, revoked ...int64) string {
+	var entries []x509.RevocationListEntry
+	for _, serial := range revoked {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-time.Minute),
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ca.crl")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckCRL(t *testing.T) {
+	ca, caKey, err := x509toolkit.GenerateCACertificate("test", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, _ := issueClientCertificate(t, ca, caKey, 1)
+	revoked, _ := issueClientCertificate(t, ca, caKey, 2)
+
+	checker, err := NewChecker([]string{writeCRL(t, ca, caKey, time.Now().Add(time.Hour), 2)}, time.Hour, false, "", false, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create checker: %v", err)
+	}
+
+	if err := checker.Check(good, ca); err != nil {
+		t.Errorf("Expected good certificate to pass, got %v", err)
+	}
+	if err := checker.VerifyConnection(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{revoked, ca}}}); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Expected revoked certificate to be rejected, got %v", err)
+	}
+}
+
+func TestCheckResumedSession(t *testing.T) {
+	ca, caKey, err := x509toolkit.GenerateCACertificate("test", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key := issueClientCertificate(t, ca, caKey, 1)
+	crlPath := writeCRL(t, ca, caKey, time.Now().Add(time.Hour))
+	checker, err := NewChecker([]string{crlPath}, time.Hour, false, "", false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert, VerifyConnection: checker.VerifyConnection}
+	server.StartTLS()
+	defer server.Close()
+
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+	transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	defer transport.CloseIdleConnections()
+	request := func() (*http.Response, error) {
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		transport.CloseIdleConnections()
+		return resp, err
+	}
+
+	if _, err := request(); err != nil {
+		t.Fatalf("Expected the certificate to be accepted, got %v", err)
+	}
+	resp, err := request()
+	if err != nil || !resp.TLS.DidResume {
+		t.Fatalf("Expected the session to be resumed, got %v", err)
+	}
+
+	// Once the certificate is revoked, the session it created can not be resumed either
+	if err := os.Rename(writeCRL(t, ca, caKey, time.Now().Add(time.Hour), 1), crlPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := checker.LoadCRLs(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(); err == nil {
+		t.Error("Expected the revoked certificate not to resume its session")
+	}
+}
+
+func TestCheckFailMode(t *testing.T) {
+	ca, caKey, err := x509toolkit.GenerateCACertificate("test", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := issueClientCertificate(t, ca, caKey, 1)
+
+	// An expired CRL can not vouch for the certificate
+	crlPath := writeCRL(t, ca, caKey, time.Now().Add(-time.Second))
+
+	closed, err := NewChecker([]string{crlPath}, time.Hour, false, "", false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := closed.Check(cert, ca); err == nil {
+		t.Error("Expected fail-closed checker to reject an unknown status")
+	}
+
+	open, err := NewChecker([]string{crlPath}, time.Hour, false, "", true, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := open.Check(cert, ca); err != nil {
+		t.Errorf("Expected fail-open checker to allow an unknown status, got %v", err)
+	}
+}
+
+func TestCheckOCSP(t *testing.T) {
+	ca, caKey, err := x509toolkit.GenerateCACertificate("test", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, _ := issueClientCertificate(t, ca, caKey, 1)
+	revoked, _ := issueClientCertificate(t, ca, caKey, 2)
+
+	// A responder signed by the CA that revokes serial 2
+	queries := 0
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		body, _ := io.ReadAll(r.Body)
+		request, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status := ocsp.Good
+		if request.SerialNumber.Int64() == 2 {
+			status = ocsp.Revoked
+		}
+		response, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       status,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(response)
+	}))
+	defer responder.Close()
+
+	checker, err := NewChecker(nil, time.Hour, true, responder.URL, false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checker.Check(good, ca); err != nil {
+		t.Errorf("Expected good certificate to pass, got %v", err)
+	}
+	if err := checker.Check(revoked, ca); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Expected revoked certificate to be rejected, got %v", err)
+	}
+
+	// The second check of the same certificate is answered from the cache
+	if err := checker.Check(good, ca); err != nil {
+		t.Errorf("Expected cached good certificate to pass, got %v", err)
+	}
+	if queries != 2 {
+		t.Errorf("Expected 2 OCSP queries, got %d", queries)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written as a string such as "30s" in JSON
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Route sends the requests matching a Host and path prefix to an upstream
+type Route struct {
+	// Name identifies the route in logs
+	Name string `json:"name"`
+	// Host matches the request host without port, "*.example.com" matches one label such as a.example.com, empty matches every host
+	Host string `json:"host"`
+	// Prefix matches the start of the request path, defaults to "/"
+	Prefix string `json:"prefix"`
+	// StripPrefix removes Prefix from the path before forwarding
+	StripPrefix bool `json:"strip_prefix"`
+	// Rewrite replaces Prefix in the forwarded path, for example /api/ to /v1/
+	Rewrite string `json:"rewrite"`
+	// Upstream is the URL to forward to, a missing scheme means http
+	Upstream string `json:"upstream"`
+	// Timeout bounds the whole request, zero means no timeout. It does not apply to upgraded connections.
+	Timeout Duration `json:"timeout"`
+	// IdleTimeout closes a response or upgraded connection when no data flowed for this long, zero means never
+	IdleTimeout Duration `json:"idle_timeout"`
+	// MaxDuration bounds every request including upgraded connections such as WebSockets, zero means no limit
+	MaxDuration Duration `json:"max_duration"`
+	// FlushInterval batches the writes of a response, zero flushes every write so streams reach the client promptly
+	FlushInterval Duration `json:"flush_interval"`
+	// TLS configures an https upstream, the system roots are trusted when it is not set
+	TLS *UpstreamTLS `json:"tls"`
+	// RateLimit throttles each client identity and IP address, no limit when not set
+	RateLimit *RateLimit `json:"rate_limit"`
+
+	target     *url.URL
+	proxy      *httputil.ReverseProxy
+	clientCert *CertReloader
+	limiters   *routeLimiters
+	metrics    *ProxyMetrics
+}
+
+// Router forwards each request to the upstream of the most specific matching route.
+// Routes with a Host beat routes without one, then the longest Prefix wins.
+type Router struct {
+	routes []*Route
+}
+
+// ParseRoutes decodes a JSON array of routes
+func ParseRoutes(data string) ([]Route, error) {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var routes []Route
+	if err := decoder.Decode(&routes); err != nil {
+		return nil, fmt.Errorf("invalid routes: %v", err)
+	}
+	return routes, nil
+}
+
+// NewRouter validates the routes and creates a reverse proxy for each of them
+func NewRouter(routes []Route) (*Router, error) {
+	if len(routes) == 0 {
+		return nil, errors.New("no routes configured")
+	}
+
+	router := &Router{}
+	var errs []error
+	for i := range routes {
+		route := routes[i]
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route-%d", i)
+		}
+		if route.Prefix == "" {
+			route.Prefix = "/"
+		}
+		if !strings.HasPrefix(route.Prefix, "/") {
+			errs = append(errs, fmt.Errorf("route %s: prefix %q must start with /", route.Name, route.Prefix))
+		}
+		if route.Rewrite != "" && !strings.HasPrefix(route.Rewrite, "/") {
+			errs = append(errs, fmt.Errorf("route %s: rewrite %q must start with /", route.Name, route.Rewrite))
+		}
+		if route.Timeout < 0 || route.IdleTimeout < 0 || route.MaxDuration < 0 || route.FlushInterval < 0 {
+			errs = append(errs, fmt.Errorf("route %s: timeout, idle_timeout, max_duration and flush_interval must not be negative", route.Name))
+		}
+		target, err := parseUpstream(route.Upstream)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %v", route.Name, err))
+			continue
+		}
+		if route.TLS != nil && target.Scheme != "https" {
+			errs = append(errs, fmt.Errorf("route %s: tls is set but upstream %q is not https", route.Name, route.Upstream))
+			continue
+		}
+		transport, clientCert, err := upstreamTransport(route.TLS)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %v", route.Name, err))
+			continue
+		}
+		if route.RateLimit != nil {
+			limit := *route.RateLimit
+			limit.Methods = append([]string(nil), limit.Methods...)
+			if err := limit.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("route %s: %v", route.Name, err))
+				continue
+			}
+			route.RateLimit = &limit
+			route.limiters = newRouteLimiters(&limit)
+		}
+		route.Host = strings.ToLower(route.Host)
+		route.target = target
+		route.clientCert = clientCert
+		route.proxy = route.newProxy()
+		route.proxy.Transport = transport
+		router.routes = append(router.routes, &route)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	sort.SliceStable(router.routes, func(i, j int) bool {
+		a, b := router.routes[i], router.routes[j]
+		if (a.Host != "") != (b.Host != "") {
+			return a.Host != ""
+		}
+		return len(a.Prefix) > len(b.Prefix)
+	})
+	return router, nil
+}
+
+// parseUpstream parses an upstream URL, accepting host:port without a scheme as http
+func parseUpstream(upstream string) (*url.URL, error) {
+	if upstream == "" {
+		return nil, errors.New("upstream must be set")
+	}
+	if !strings.Contains(upstream, "://") {
+		upstream = "http://" + upstream
+	}
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %q: %v", upstream, err)
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("upstream %q must be http or https", upstream)
+	}
+	if target.Host == "" {
+		return nil, fmt.Errorf("upstream %q has no host", upstream)
+	}
+	return target, nil
+}
+
+// Match returns the route for a request, or nil when no route matches.
+// HandleProxy cleans the path first, so it matches the path the path policy decided on.
+func (rt *Router) Match(r *http.Request) *Route {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, route := range rt.routes {
+		if route.matchHost(host) && strings.HasPrefix(r.URL.Path, route.Prefix) {
+			return route
+		}
+	}
+	return nil
+}
+
+// matchHost reports whether the route accepts a request host
+func (route *Route) matchHost(host string) bool {
+	return route.Host == "" || matchHostPattern(route.Host, host)
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := rt.Match(r)
+	if route == nil {
+		log.Printf("%sNo route for %s%s%s", colorRed, r.Host, r.URL.Path, colorReset)
+		writeErrorPage(w, http.StatusNotFound, "No service is configured for this address.")
+		return
+	}
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.Route, info.Upstream = route.Name, route.target.Host
+	}
+	route.ServeHTTP(w, r)
+}
+
+func (route *Route) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if route.limiters != nil {
+		ok, limit, wait := route.limiters.allow(r, time.Now())
+		if route.metrics != nil {
+			route.metrics.ObserveRateLimiters(route)
+		}
+		if !ok {
+			if route.metrics != nil {
+				route.metrics.rateLimited.Inc(route.Name, limit)
+			}
+			writeTooManyRequests(w, wait)
+			return
+		}
+	}
+	if route.MaxDuration > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(route.MaxDuration))
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	// An upgraded connection lives as long as the client keeps it open, only MaxDuration bounds it
+	if route.Timeout > 0 && !isUpgrade(r) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(route.Timeout))
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	if route.IdleTimeout > 0 {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		r = r.WithContext(ctx)
+		idle := newIdleWriter(w, time.Duration(route.IdleTimeout), cancel)
+		defer idle.stop()
+		w = idle
+	}
+	route.proxy.ServeHTTP(w, r)
+}
+
+// newProxy returns the reverse proxy forwarding to the route's upstream
+func (route *Route) newProxy() *httputil.ReverseProxy {
+	flushInterval := time.Duration(route.FlushInterval)
+	if flushInterval == 0 {
+		flushInterval = -1
+	}
+	return &httputil.ReverseProxy{
+		FlushInterval: flushInterval,
+		Director: func(req *http.Request) {
+			req.URL.Scheme = route.target.Scheme
+			req.URL.Host = route.target.Host
+			req.URL.Path = joinPath(route.target.Path, route.rewritePath(req.URL.Path))
+			if req.URL.RawPath != "" {
+				req.URL.RawPath = joinPath(route.target.EscapedPath(), route.rewritePath(req.URL.RawPath))
+			}
+			if route.target.RawQuery != "" {
+				req.URL.RawQuery = route.target.RawQuery + "&" + req.URL.RawQuery
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			status := http.StatusBadGateway
+			if errors.Is(err, context.DeadlineExceeded) {
+				status = http.StatusGatewayTimeout
+			}
+			log.Printf("%sError proxying %s to route %s (%s): %v%s", colorRed, r.URL.Path, route.Name, route.target.Host, err, colorReset)
+			writeErrorPage(w, status, "The service is not available, please try again later.")
+		},
+	}
+}
+
+// rewritePath applies StripPrefix and Rewrite to a request path, the result always starts with /
+func (route *Route) rewritePath(path string) string {
+	if route.Rewrite == "" && !route.StripPrefix {
+		return path
+	}
+	rest := strings.TrimPrefix(path, route.Prefix)
+	if route.Rewrite != "" {
+		if strings.HasSuffix(route.Rewrite, "/") || rest == "" || strings.HasPrefix(rest, "/") {
+			return route.Rewrite + rest
+		}
+		return route.Rewrite + "/" + rest
+	}
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return rest
+}
+
+// joinPath appends a request path to the upstream's base path
+func joinPath(base string, path string) string {
+	if base == "" || base == "/" {
+		return path
+	}
+	return strings.TrimSuffix(base, "/") + path
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoUpstream answers every request with its name and the path it received
+func echoUpstream(t *testing.T, name string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name+" "+r.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRouter(t *testing.T) {
+	api := echoUpstream(t, "api")
+	frontend := echoUpstream(t, "frontend")
+	admin := echoUpstream(t, "admin")
+
+	routes, err := ParseRoutes(`[
+		{"name": "api", "prefix": "/api/", "strip_prefix": true, "upstream": "` + api.URL + `", "timeout": "30s"},
+		{"name": "v1", "prefix": "/legacy/", "rewrite": "/api/v1/", "upstream": "` + strings.TrimPrefix(api.URL, "http://") + `"},
+		{"name": "admin", "host": "admin.example.com", "prefix": "/", "upstream": "` + admin.URL + `/console"},
+		{"name": "tenants", "host": "*.tenants.example.com", "prefix": "/", "upstream": "` + admin.URL + `/tenants"},
+		{"name": "frontend", "prefix": "/", "upstream": "` + frontend.URL + `"}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host     string
+		path     string
+		expected string
+	}{
+		{"example.com", "/api/users", "api /users"},
+		{"example.com", "/legacy/users", "api /api/v1/users"},
+		{"example.com", "/index.html", "frontend /index.html"},
+		{"admin.example.com:8443", "/api/users", "admin /console/api/users"},
+		{"ADMIN.example.com", "/", "admin /console/"},
+		{"acme.tenants.example.com", "/", "admin /tenants/"},
+		{"eu.acme.tenants.example.com", "/", "frontend /"},
+		{"tenants.example.com", "/", "frontend /"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://"+test.host+test.path, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Body.String() != test.expected {
+			t.Errorf("Expected %s%s to reach %q, got %q", test.host, test.path, test.expected, rr.Body.String())
+		}
+	}
+}
+
+func TestRouterTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	router, err := NewRouter([]Route{{Name: "slow", Upstream: slow.URL, Timeout: Duration(50 * time.Millisecond)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com/", nil))
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected %d, got %d", http.StatusGatewayTimeout, rr.Code)
+	}
+}
+
+func TestNewRouterInvalid(t *testing.T) {
+	_, err := NewRouter([]Route{
+		{Name: "a", Prefix: "api", Upstream: "http://backend"},
+		{Name: "b", Upstream: "ftp://backend"},
+		{Name: "c"},
+	})
+	if err == nil {
+		t.Fatal("Expected invalid routes to be rejected")
+	}
+	// Every problem is reported at once
+	for _, name := range []string{"route a", "route b", "route c"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("Expected an error for %s, got %v", name, err)
+		}
+	}
+
+	if _, err := ParseRoutes(`[{"prefix": "/", "upstream": "http://backend", "timeout": 30}]`); err == nil {
+		t.Error("Expected a numeric timeout to be rejected")
+	}
+}
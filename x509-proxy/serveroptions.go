@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"dn"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// defaultCipherSuites are the TLS 1.2 suites offered by default: forward secret AEAD suites only.
+// TLS 1.3 suites are not configurable and always secure.
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// ServerOptions harden the client facing server against slow clients, large headers and weak TLS
+type ServerOptions struct {
+	// MinVersion is the lowest TLS version accepted, tls.VersionTLS12 or tls.VersionTLS13
+	MinVersion uint16
+	// CipherSuites are the TLS 1.2 cipher suites offered
+	CipherSuites []uint16
+	// ReadHeaderTimeout bounds reading the request headers
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds reading the whole request including the body, zero means no limit
+	ReadTimeout time.Duration
+	// WriteTimeout bounds writing the response, zero means no limit so streams are not cut
+	WriteTimeout time.Duration
+	// IdleTimeout closes keep-alive connections waiting for the next request
+	IdleTimeout time.Duration
+	// MaxHeaderBytes caps the size of the request headers
+	MaxHeaderBytes int
+}
+
+// ParseTLSVersion parses a minimum TLS version, only 1.2 and 1.3 are accepted
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("TLS version must be 1.2 or 1.3, got %q", version)
+}
+
+// ParseCipherSuites parses TLS 1.2 cipher suite names such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+// Insecure suites are rejected, and one of the AES-128-GCM suites HTTP/2 requires must be included.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	secure := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	var suites []uint16
+	var errs []error
+	http2 := false
+	for _, name := range names {
+		suite, found := secure[name]
+		switch {
+		case insecure[name]:
+			errs = append(errs, fmt.Errorf("cipher suite %s is insecure", name))
+		case !found:
+			errs = append(errs, fmt.Errorf("unknown cipher suite %s", name))
+		default:
+			suites = append(suites, suite.ID)
+			http2 = http2 || suite.ID == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || suite.ID == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+		}
+	}
+	if len(errs) == 0 && len(suites) > 0 && !http2 {
+		errs = append(errs, errors.New("cipher suites must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 for HTTP/2"))
+	}
+	return suites, errors.Join(errs...)
+}
+
+// Apply sets the timeouts, header limit and TLS settings on server, whose TLSConfig must be set
+func (o ServerOptions) Apply(server *http.Server) {
+	server.ReadHeaderTimeout = o.ReadHeaderTimeout
+	server.ReadTimeout = o.ReadTimeout
+	server.WriteTimeout = o.WriteTimeout
+	server.IdleTimeout = o.IdleTimeout
+	server.MaxHeaderBytes = o.MaxHeaderBytes
+	server.TLSConfig.MinVersion = o.MinVersion
+	server.TLSConfig.CipherSuites = o.CipherSuites
+}
+
+// LogTLSConnections wraps a tls.Config.GetConfigForClient callback so every handshake that
+// completes verification logs its negotiated parameters, before the config's own VerifyConnection runs.
+func LogTLSConnections(logger *slog.Logger, next func(*tls.ClientHelloInfo) (*tls.Config, error)) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		config, err := next(hello)
+		if err != nil || config == nil {
+			return config, err
+		}
+		remoteAddr := hello.Conn.RemoteAddr().String()
+		verify := config.VerifyConnection
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			attrs := []slog.Attr{
+				slog.String("remote_addr", remoteAddr),
+				slog.String("version", tls.VersionName(state.Version)),
+				slog.String("cipher_suite", tls.CipherSuiteName(state.CipherSuite)),
+				slog.String("server_name", state.ServerName),
+				slog.String("alpn", state.NegotiatedProtocol),
+				slog.Bool("resumed", state.DidResume),
+			}
+			if len(state.PeerCertificates) > 0 {
+				attrs = append(attrs, slog.String("dn", dn.FromCertificate(state.PeerCertificates[0]).String()))
+			}
+			logger.LogAttrs(context.Background(), slog.LevelInfo, "tls", attrs...)
+			if verify != nil {
+				return verify(state)
+			}
+			return nil
+		}
+		return config, nil
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"x509-proxy/x509toolkit"
+)
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"})
+	if err != nil || len(suites) != 2 {
+		t.Fatalf("Expected two suites, got %v %v", suites, err)
+	}
+	tests := []struct {
+		names    []string
+		expected string
+	}{
+		{[]string{"TLS_RSA_WITH_RC4_128_SHA", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, "insecure"},
+		{[]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_NULL"}, "unknown"},
+		{[]string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}, "HTTP/2"},
+	}
+	for _, test := range tests {
+		if _, err := ParseCipherSuites(test.names); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%v: expected an error about %s, got %v", test.names, test.expected, err)
+		}
+	}
+	if _, err := ParseTLSVersion("1.1"); err == nil {
+		t.Error("Expected TLS 1.1 to be rejected")
+	}
+}
+
+// syncBuffer is a log destination safe to write from the server goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServerOptions(t *testing.T) {
+	ca, caKey, err := x509toolkit.GenerateCACertificate("server-ca", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key := issueCertificate(t, ca, caKey, "localhost", x509.ExtKeyUsageServerAuth)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	var logs syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	base := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}}
+	base.GetConfigForClient = LogTLSConnections(logger, func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		config := base.Clone()
+		config.GetConfigForClient = nil
+		return config, nil
+	})
+	server := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		TLSConfig: base,
+	}
+	ServerOptions{
+		MinVersion:        tls.VersionTLS12,
+		CipherSuites:      defaultCipherSuites,
+		ReadHeaderTimeout: time.Second,
+		MaxHeaderBytes:    4096,
+	}.Apply(server)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+	url := "https://localhost:" + strings.Split(listener.Addr().String(), ":")[1]
+
+	get := func(clientConfig *tls.Config, header string) (*http.Response, error) {
+		clientConfig.RootCAs = roots
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("X-Large", header)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	if _, err := get(&tls.Config{MaxVersion: tls.VersionTLS11}, ""); err == nil {
+		t.Error("Expected TLS 1.1 to be rejected")
+	}
+	if _, err := get(&tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA}}, ""); err == nil {
+		t.Error("Expected a CBC cipher suite to be rejected")
+	}
+	resp, err := get(&tls.Config{MaxVersion: tls.VersionTLS12}, "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected TLS 1.2 with a curated suite to be accepted, got %v", err)
+	}
+	if !strings.Contains(logs.String(), `"msg":"tls"`) || !strings.Contains(logs.String(), `"version":"TLS 1.2"`) ||
+		!strings.Contains(logs.String(), `"cipher_suite":"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"`) {
+		t.Errorf("Expected the negotiated parameters to be logged, got %s", logs.String())
+	}
+
+	resp, err = get(&tls.Config{}, strings.Repeat("a", 8192))
+	if err != nil || resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected headers over the limit to be rejected with 431, got %v %v", resp, err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TLSHost is a server certificate and client CA bundle served to clients asking for some host names
+type TLSHost struct {
+	// Hosts are the server names this certificate is selected for, "*.example.com" matches one label such as a.example.com.
+	// Empty means the DNS names of the certificate.
+	Hosts []string `json:"hosts"`
+	// Cert and Key are the paths of the server certificate and key
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// CA is the path of the bundle client certificates must chain to, CA_CERT when empty
+	CA string `json:"ca"`
+}
+
+// ParseTLSHosts decodes a JSON array of TLS hosts
+func ParseTLSHosts(data string) ([]TLSHost, error) {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var hosts []TLSHost
+	if err := decoder.Decode(&hosts); err != nil {
+		return nil, fmt.Errorf("invalid TLS hosts: %v", err)
+	}
+	for i, host := range hosts {
+		if host.Cert == "" || host.Key == "" {
+			return nil, fmt.Errorf("invalid TLS hosts: cert and key of host %d must be set", i)
+		}
+	}
+	return hosts, nil
+}
+
+// sniHost is a loaded TLSHost
+type sniHost struct {
+	hosts    []string
+	reloader *CertReloader
+}
+
+// names returns the server names of the host, from its certificate when none are configured
+func (h *sniHost) names() []string {
+	if len(h.hosts) > 0 {
+		return h.hosts
+	}
+	if cert := h.reloader.Certificate(); cert != nil && cert.Leaf != nil {
+		names := make([]string, len(cert.Leaf.DNSNames))
+		for i, name := range cert.Leaf.DNSNames {
+			names[i] = strings.ToLower(name)
+		}
+		return names
+	}
+	return nil
+}
+
+// SNIReloader serves the certificate and client CA pool of the host each client asks for, and keeps them up to date
+type SNIReloader struct {
+	hosts []*sniHost
+	// fallback serves clients asking for no name or an unknown one
+	fallback *sniHost
+	// all are the hosts and the fallback, each once
+	all []*sniHost
+}
+
+// NewSNIReloader loads every host, reporting all that fail. fallback serves names no host matches,
+// the first host does when it is nil. A host without a CA uses defaultCA.
+func NewSNIReloader(hosts []TLSHost, fallback *TLSHost, defaultCA string) (*SNIReloader, error) {
+	s := &SNIReloader{}
+	var errs []error
+	load := func(host TLSHost) *sniHost {
+		ca := host.CA
+		if ca == "" {
+			ca = defaultCA
+		}
+		if ca == "" {
+			errs = append(errs, fmt.Errorf("certificate %s: no client CA, set ca or CA_CERT", host.Cert))
+			return nil
+		}
+		reloader, err := NewCertReloader(host.Cert, host.Key, ca)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("certificate %s: %v", host.Cert, err))
+			return nil
+		}
+		lowered := make([]string, len(host.Hosts))
+		for i, name := range host.Hosts {
+			lowered[i] = strings.ToLower(name)
+		}
+		return &sniHost{hosts: lowered, reloader: reloader}
+	}
+
+	for _, host := range hosts {
+		if loaded := load(host); loaded != nil {
+			s.hosts = append(s.hosts, loaded)
+		}
+	}
+	if fallback != nil {
+		s.fallback = load(*fallback)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	s.all = append([]*sniHost{}, s.hosts...)
+	if s.fallback != nil {
+		s.all = append(s.all, s.fallback)
+	} else if len(s.hosts) > 0 {
+		s.fallback = s.hosts[0]
+	} else {
+		return nil, errors.New("no server certificate configured")
+	}
+	return s, nil
+}
+
+// NewServerCertificates loads the certificates of a config: the TLS_HOSTS selected by SNI, and TLS_CERT
+// for clients asking for none of their hosts, or for every client when TLS_HOSTS is not set.
+func NewServerCertificates(config GlobalConfig) (*SNIReloader, error) {
+	var fallback *TLSHost
+	if config.TLSCert != "" || len(config.TLSHosts) == 0 {
+		fallback = &TLSHost{Cert: config.TLSCert, Key: config.TLSKey, CA: config.CACertPath}
+	}
+	return NewSNIReloader(config.TLSHosts, fallback, config.CACertPath)
+}
+
+// match returns the host serving a server name: an exact name first, then the longest wildcard, then the fallback
+func (s *SNIReloader) match(serverName string) *sniHost {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if serverName == "" {
+		return s.fallback
+	}
+	var best *sniHost
+	bestLength := 0
+	for _, host := range s.all {
+		for _, name := range host.names() {
+			if name == serverName {
+				return host
+			}
+			if matchHostPattern(name, serverName) && len(name) > bestLength {
+				best, bestLength = host, len(name)
+			}
+		}
+	}
+	if best != nil {
+		return best
+	}
+	return s.fallback
+}
+
+// matchHostPattern reports whether host matches a name, "*.example.com" matching exactly one label
+// before example.com like a certificate wildcard: a.example.com, but not example.com or a.b.example.com
+func matchHostPattern(pattern string, host string) bool {
+	if pattern == host {
+		return true
+	}
+	if suffix, found := strings.CutPrefix(pattern, "*."); found {
+		label, found := strings.CutSuffix(host, "."+suffix)
+		return found && label != "" && !strings.Contains(label, ".")
+	}
+	return false
+}
+
+// Watch reloads the files of every host every interval until stop is closed
+func (s *SNIReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	for _, host := range s.all {
+		go host.reloader.Watch(interval, stop)
+	}
+}
+
+// Certificate returns the server certificate expiring first, for the expiry metric
+func (s *SNIReloader) Certificate() *tls.Certificate {
+	var first *tls.Certificate
+	for _, host := range s.all {
+		cert := host.reloader.Certificate()
+		if cert != nil && cert.Leaf != nil && (first == nil || cert.Leaf.NotAfter.Before(first.Leaf.NotAfter)) {
+			first = cert
+		}
+	}
+	return first
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (s *SNIReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.match(hello.ServerName).reloader.Certificate(), nil
+}
+
+// ClientCAs returns the current client CA pool of the host serving a server name
+func (s *SNIReloader) ClientCAs(serverName string) *x509.CertPool {
+	return s.match(serverName).reloader.CAPool()
+}
+
+// GetConfigForClient returns a tls.Config.GetConfigForClient callback that serves base with the
+// current certificate and client CA pool of the host the client asks for.
+func (s *SNIReloader) GetConfigForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		host := s.match(hello.ServerName)
+		config := base.Clone()
+		config.GetCertificate = host.reloader.GetCertificate
+		config.ClientCAs = host.reloader.CAPool()
+		config.GetConfigForClient = nil
+
+		// Every host shares the session ticket keys of base, so a session resumed on this host may have been
+		// created on another one, or before the CA bundle was reloaded. Not every Go release checks it against
+		// ClientCAs, so its client certificate is verified again.
+		verify := base.VerifyConnection
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if state.DidResume && len(state.PeerCertificates) > 0 {
+				chains, err := verifyClientCertificate(state.PeerCertificates, config.ClientCAs)
+				if err != nil {
+					return err
+				}
+				state.VerifiedChains = chains
+			}
+			if verify != nil {
+				return verify(state)
+			}
+			return nil
+		}
+		return config, nil
+	}
+}
+
+// verifyClientCertificate verifies the first certificate for client authentication against roots,
+// the others are intermediates, and returns its verified chains
+func verifyClientCertificate(certs []*x509.Certificate, roots *x509.CertPool) ([][]*x509.Certificate, error) {
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	return certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+// CheckHost answers 421 Misdirected Request when the Host header names another certificate's host than the
+// one the connection was verified for, so a client certificate trusted for one host can not reach another.
+func (s *SNIReloader) CheckHost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(s.hosts) > 0 {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if s.match(r.TLS.ServerName) != s.match(host) {
+				log.Printf("%sRejected request for %s on a connection for %s from %s%s", colorRed, host, r.TLS.ServerName, r.RemoteAddr, colorReset)
+				writeErrorPage(w, http.StatusMisdirectedRequest, "This connection can not be used for the requested host.")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
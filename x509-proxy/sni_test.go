@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"x509-proxy/x509toolkit"
+)
+
+func TestParseTLSHosts(t *testing.T) {
+	hosts, err := ParseTLSHosts(`[{"hosts": ["ui.example.com"], "cert": "/a.crt", "key": "/a.key", "ca": "/ca.crt"}, {"cert": "/b.crt", "key": "/b.key"}]`)
+	if err != nil {
+		t.Fatalf("Failed to parse TLS hosts: %v", err)
+	}
+	if len(hosts) != 2 || hosts[0].Hosts[0] != "ui.example.com" || hosts[0].CA != "/ca.crt" || hosts[1].Cert != "/b.crt" {
+		t.Errorf("Unexpected TLS hosts %+v", hosts)
+	}
+
+	for _, invalid := range []string{
+		`{"cert": "/a.crt"}`,
+		`[{"cert": "/a.crt"}]`,
+		`[{"cert": "/a.crt", "key": "/a.key", "certificate": "/b.crt"}]`,
+	} {
+		if _, err := ParseTLSHosts(invalid); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestSNIReloader(t *testing.T) {
+	dir := t.TempDir()
+	caA, caAKey, err := x509toolkit.GenerateCACertificate("ca-a", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caB, caBKey, err := x509toolkit.GenerateCACertificate("ca-b", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caAPath := filepath.Join(dir, "ca-a.crt")
+	caBPath := filepath.Join(dir, "ca-b.crt")
+	writeKeyPair(t, caA, caAKey, caAPath, filepath.Join(dir, "ca-a.key"))
+	writeKeyPair(t, caB, caBKey, caBPath, filepath.Join(dir, "ca-b.key"))
+
+	// a.example.com trusts CA_CERT, the wildcard host takes its names from its certificate and trusts its own CA
+	a := writeTLSHost(t, dir, caA, caAKey, "a.example.com", "a")
+	a.Hosts = []string{"A.example.com"}
+	b := writeTLSHost(t, dir, caA, caAKey, "*.b.example.com", "b")
+	b.CA = caBPath
+	fallback := writeTLSHost(t, dir, caA, caAKey, "default.example.com", "default")
+
+	certificates, err := NewServerCertificates(GlobalConfig{
+		TLSCert:    fallback.Cert,
+		TLSKey:     fallback.Key,
+		CACertPath: caAPath,
+		TLSHosts:   []TLSHost{a, b},
+	})
+	if err != nil {
+		t.Fatalf("Failed to load certificates: %v", err)
+	}
+
+	for _, test := range []struct {
+		serverName string
+		expected   string
+	}{
+		{"a.example.com", "a.example.com"},
+		{"a.example.com.", "a.example.com"},
+		{"x.b.example.com", "*.b.example.com"},
+		{"X.B.example.com", "*.b.example.com"},
+		{"y.x.b.example.com", "default.example.com"},
+		{"b.example.com", "default.example.com"},
+		{"unknown.example.com", "default.example.com"},
+		{"", "default.example.com"},
+	} {
+		cert, _ := certificates.GetCertificate(&tls.ClientHelloInfo{ServerName: test.serverName})
+		if name := cert.Leaf.DNSNames[0]; name != test.expected {
+			t.Errorf("Expected %q to be served %s, got %s", test.serverName, test.expected, name)
+		}
+	}
+
+	server := httptest.NewUnstartedServer(certificates.CheckHost(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+	base := &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}
+	base.GetConfigForClient = certificates.GetConfigForClient(base)
+	server.TLS = base
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caA)
+	clientA := clientCertificate(t, caA, caAKey, "client-a")
+	clientB := clientCertificate(t, caB, caBKey, "client-b")
+	get := func(serverName string, host string, cert tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			ServerName:   serverName,
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{cert},
+		}}}
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		return client.Do(req)
+	}
+
+	// Each host only accepts clients of its own CA
+	for _, test := range []struct {
+		serverName string
+		cert       tls.Certificate
+		accepted   bool
+	}{
+		{"a.example.com", clientA, true},
+		{"a.example.com", clientB, false},
+		{"x.b.example.com", clientB, true},
+		{"x.b.example.com", clientA, false},
+		{"default.example.com", clientA, true},
+	} {
+		resp, err := get(test.serverName, test.serverName, test.cert)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if accepted := err == nil && resp.StatusCode == http.StatusOK; accepted != test.accepted {
+			t.Errorf("Expected %s accepting %s to be %v, got %v", test.serverName, test.cert.Leaf.Subject.CommonName, test.accepted, err)
+		}
+	}
+
+	// A connection verified for one host can not be used for another
+	resp, err := get("a.example.com", "x.b.example.com", clientA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMisdirectedRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusMisdirectedRequest, resp.StatusCode)
+	}
+
+	// The wildcard covers one label, a deeper name belongs to the default host
+	resp, err = get("x.b.example.com", "y.x.b.example.com", clientB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMisdirectedRequest {
+		t.Errorf("Expected status %d for a name below the wildcard, got %d", http.StatusMisdirectedRequest, resp.StatusCode)
+	}
+	resp, err = get("a.example.com", "A.example.com:443", clientA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the same host with a port to be accepted, got %d", resp.StatusCode)
+	}
+
+	// Session tickets are shared by the hosts, so a client can offer the ticket of one to another.
+	// Not verifying the server lets the client resume a session whatever the name it asks for.
+	cache := &sharedSessionCache{}
+	resume := func(serverName string) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{clientA},
+			ClientSessionCache: cache,
+		}}}
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = serverName
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		client.CloseIdleConnections()
+		return resp, err
+	}
+	if _, err := resume("a.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := resume("a.example.com"); err != nil || !resp.TLS.DidResume {
+		t.Fatalf("Expected the session to be resumed on its own host, got %v", err)
+	}
+	if resp, err := resume("x.b.example.com"); err == nil && resp.StatusCode == http.StatusOK {
+		t.Error("Expected a session of a.example.com not to be resumed on x.b.example.com, whose CA does not trust the client")
+	}
+}
+
+// sharedSessionCache offers the last session it got to every server name
+type sharedSessionCache struct {
+	mu      sync.Mutex
+	session *tls.ClientSessionState
+}
+
+func (c *sharedSessionCache) Get(string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session, c.session != nil
+}
+
+func (c *sharedSessionCache) Put(_ string, session *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if session != nil {
+		c.session = session
+	}
+}
+
+func TestNewSNIReloaderErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, err := x509toolkit.GenerateCACertificate("ca", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := writeTLSHost(t, dir, ca, caKey, "a.example.com", "a")
+
+	// Without CA_CERT every host needs its own CA, and every failing host is reported
+	_, err = NewSNIReloader([]TLSHost{host, {Cert: filepath.Join(dir, "missing.crt"), Key: host.Key, CA: host.Cert}}, nil, "")
+	if err == nil || !strings.Contains(err.Error(), "no client CA") || !strings.Contains(err.Error(), "missing.crt") {
+		t.Errorf("Expected both hosts to be reported, got %v", err)
+	}
+	if _, err := NewSNIReloader(nil, nil, ""); err == nil {
+		t.Error("Expected an error without any certificate")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isUpgrade reports whether a request asks to switch protocols, such as a WebSocket handshake
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// idleWriter cancels a request when no data flows for the idle timeout after the response started.
+// For an upgraded connection data in either direction counts, for a response every write does.
+type idleWriter struct {
+	http.ResponseWriter
+	timeout time.Duration
+	cancel  context.CancelFunc
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+func newIdleWriter(w http.ResponseWriter, timeout time.Duration, cancel context.CancelFunc) *idleWriter {
+	return &idleWriter{ResponseWriter: w, timeout: timeout, cancel: cancel}
+}
+
+// active starts or restarts the idle timer
+func (w *idleWriter) active() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.timeout, w.cancel)
+		return
+	}
+	w.timer.Reset(w.timeout)
+}
+
+// stop releases the timer once the request is done
+func (w *idleWriter) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+func (w *idleWriter) WriteHeader(status int) {
+	w.active()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idleWriter) Write(b []byte) (int, error) {
+	w.active()
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack hands the upgraded connection to the reverse proxy, counting its traffic as activity
+func (w *idleWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.active()
+	return &idleConn{Conn: conn, w: w}, brw, nil
+}
+
+// Unwrap lets http.ResponseController flush the underlying writer
+func (w *idleWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// idleConn is an upgraded client connection restarting the idle timer on every read and write
+type idleConn struct {
+	net.Conn
+	w *idleWriter
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.w.active()
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.w.active()
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// echoUpgradeUpstream switches to a line echo protocol, reporting the DN header it received
+func echoUpgradeUpstream(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgrade(r) {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\nX-Echo-Dn: %s\r\n\r\n", r.Header.Get("X-Client-Dn"))
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// streamProxy serves route through HandleProxy as if jane presented her certificate
+func streamProxy(t *testing.T, route Route) *httptest.Server {
+	router, err := NewRouter([]Route{route})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "jane"}}
+	headers := HttpHeaderMap{CN: "X-Client-Cn", DN: "X-Client-Dn"}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := httptest.NewServer(AccessLog(logger, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		HandleProxy(w, r, GlobalConfig{}, router, headers)
+	})))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// dialUpgrade opens an upgraded connection through the proxy, trying to forge the DN header
+func dialUpgrade(t *testing.T, proxy *httptest.Server) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\nX-Client-Dn: CN=admin\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, resp
+}
+
+// echo sends a line and reads it back
+func echo(conn net.Conn, reader *bufio.Reader, line string) error {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.WriteString(conn, line+"\n"); err != nil {
+		return err
+	}
+	got, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if got != line+"\n" {
+		return fmt.Errorf("expected %q back, got %q", line, got)
+	}
+	return nil
+}
+
+func TestUpgrade(t *testing.T) {
+	upstream := echoUpgradeUpstream(t)
+	proxy := streamProxy(t, Route{Name: "ws", Upstream: upstream.URL, Timeout: Duration(50 * time.Millisecond)})
+
+	conn, reader, resp := dialUpgrade(t, proxy)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %d", resp.StatusCode)
+	}
+	if dn := resp.Header.Get("X-Echo-Dn"); dn != "CN=jane" {
+		t.Errorf("Expected the upstream to get the real DN, got %q", dn)
+	}
+
+	// The route timeout does not cut upgraded connections
+	time.Sleep(100 * time.Millisecond)
+	if err := echo(conn, reader, "ping"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgradeIdleTimeout(t *testing.T) {
+	upstream := echoUpgradeUpstream(t)
+	proxy := streamProxy(t, Route{Name: "ws", Upstream: upstream.URL, IdleTimeout: Duration(150 * time.Millisecond)})
+
+	conn, reader, _ := dialUpgrade(t, proxy)
+	for i := 0; i < 4; i++ {
+		time.Sleep(75 * time.Millisecond)
+		if err := echo(conn, reader, "ping"); err != nil {
+			t.Fatalf("Expected an active connection to stay open: %v", err)
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.ReadString('\n'); err == nil || isTimeout(err) {
+		t.Errorf("Expected the idle connection to be closed by the proxy, got %v", err)
+	}
+}
+
+func TestUpgradeMaxDuration(t *testing.T) {
+	upstream := echoUpgradeUpstream(t)
+	proxy := streamProxy(t, Route{Name: "ws", Upstream: upstream.URL, MaxDuration: Duration(200 * time.Millisecond)})
+
+	conn, reader, _ := dialUpgrade(t, proxy)
+	start := time.Now()
+	for time.Since(start) < 2*time.Second {
+		if err := echo(conn, reader, "ping"); err != nil {
+			if isTimeout(err) {
+				t.Fatalf("Expected the proxy to close the connection, got %v", err)
+			}
+			return
+		}
+		time.Sleep(25 * time.Millisecond)
+	}
+	t.Error("Expected the connection to be closed after max_duration")
+}
+
+func TestStreamingResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first\n")
+		http.NewResponseController(w).Flush()
+		// Stall like a quiet watch stream until the proxy gives up
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+	proxy := streamProxy(t, Route{Name: "watch", Upstream: upstream.URL, IdleTimeout: Duration(200 * time.Millisecond)})
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(proxy.URL + "/watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The first event arrives while the upstream is still streaming
+	reader := bufio.NewReader(resp.Body)
+	if line, err := reader.ReadString('\n'); err != nil || line != "first\n" {
+		t.Fatalf("Expected the first line to be flushed, got %q %v", line, err)
+	}
+	start := time.Now()
+	if _, err := io.ReadAll(reader); err == nil {
+		t.Error("Expected the idle stream to be aborted")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the idle timeout to end the stream, took %s", elapsed)
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func TestIsUpgrade(t *testing.T) {
+	tests := []struct {
+		connection string
+		upgrade    string
+		expected   bool
+	}{
+		{"Upgrade", "websocket", true},
+		{"keep-alive, upgrade", "websocket", true},
+		{"keep-alive", "websocket", false},
+		{"Upgrade", "", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Connection", test.connection)
+		if test.upgrade != "" {
+			r.Header.Set("Upgrade", test.upgrade)
+		}
+		if got := isUpgrade(r); got != test.expected {
+			t.Errorf("Connection %q Upgrade %q: expected %t, got %t", test.connection, test.upgrade, test.expected, got)
+		}
+	}
+}
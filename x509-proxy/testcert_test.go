@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"x509-proxy/x509toolkit"
+)
+
+// signCertificate issues template with the given public key from the CA
+func signCertificate(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, template *x509.Certificate, pub any) *x509.Certificate {
+	cert, err := x509toolkit.SignCertificate(template, pub, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// issueCertificate signs a leaf certificate for the given DNS name and extended key usage, valid for an hour
+func issueCertificate(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, name string, usage x509.ExtKeyUsage) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := signCertificate(t, ca, caKey, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    []string{name},
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+	}, &key.PublicKey)
+	return cert, key
+}
+
+// clientCertificate issues a client certificate from ca
+func clientCertificate(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, name string) tls.Certificate {
+	cert, key := issueCertificate(t, ca, caKey, name, x509.ExtKeyUsageClientAuth)
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+}
+
+// writeKeyPair writes a certificate and its key as PEM files
+func writeKeyPair(t *testing.T, cert *x509.Certificate, key *ecdsa.PrivateKey, certPath string, keyPath string) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTLSHost issues a server certificate for name from ca and writes it to dir
+func writeTLSHost(t *testing.T, dir string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, name string, file string) TLSHost {
+	cert, key := issueCertificate(t, ca, caKey, name, x509.ExtKeyUsageServerAuth)
+	host := TLSHost{Cert: filepath.Join(dir, file+".crt"), Key: filepath.Join(dir, file+".key")}
+	writeKeyPair(t, cert, key, host.Cert, host.Key)
+	return host
+}
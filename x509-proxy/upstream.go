@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// UpstreamTLS configures the connection from the proxy to an https upstream
+type UpstreamTLS struct {
+	// CA is the PEM bundle the upstream certificate must chain to, the system roots when empty
+	CA string `json:"ca"`
+	// ServerName overrides the name checked in the upstream certificate, the upstream host by default
+	ServerName string `json:"server_name"`
+	// ClientCert and ClientKey are presented to upstreams that require mTLS, reloaded when they change
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+}
+
+// upstreamTransport returns the transport for an upstream, with its own TLS settings when configured.
+// The returned reloader is nil unless a client certificate is configured.
+func upstreamTransport(config *UpstreamTLS) (*http.Transport, *CertReloader, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config == nil {
+		return transport, nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: config.ServerName,
+	}
+	if config.CA != "" {
+		pool, err := LoadCACertPool(config.CA)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	var reloader *CertReloader
+	if config.ClientCert != "" || config.ClientKey != "" {
+		if config.ClientCert == "" || config.ClientKey == "" {
+			return nil, nil, errors.New("client_cert and client_key must be set together")
+		}
+		var err error
+		reloader, err = NewCertReloader(config.ClientCert, config.ClientKey, "")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load upstream client certificate: %v", err)
+		}
+		// Always present the current certificate, even if the upstream's CA list does not name its issuer
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return reloader.Certificate(), nil
+		}
+	}
+
+	transport.TLSClientConfig = tlsConfig
+	return transport, reloader, nil
+}
+
+// Watch reloads the upstream client certificates every interval until stop is closed
+func (rt *Router) Watch(interval time.Duration, stop <-chan struct{}) {
+	for _, route := range rt.routes {
+		if route.clientCert != nil {
+			go route.clientCert.Watch(interval, stop)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"x509-proxy/x509toolkit"
+)
+
+func TestRouterUpstreamMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, err := x509toolkit.GenerateCACertificate("upstream-ca", "US", "test", "testOU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPath := filepath.Join(dir, "ca.crt")
+	writeKeyPair(t, ca, caKey, caPath, filepath.Join(dir, "ca.key"))
+
+	// The backend only accepts the proxy's client certificate, and its certificate names the service
+	serverCert, serverKey := issueCertificate(t, ca, caKey, "pwck8s-backend", x509.ExtKeyUsageServerAuth)
+	writeKeyPair(t, serverCert, serverKey, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	serverPair, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPool := x509.NewCertPool()
+	clientPool.AddCert(ca)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		ClientCAs:    clientPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	clientCert, clientKey := issueCertificate(t, ca, caKey, "x509-proxy", x509.ExtKeyUsageClientAuth)
+	clientCertPath, clientKeyPath := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeKeyPair(t, clientCert, clientKey, clientCertPath, clientKeyPath)
+
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	upstream := "https://127.0.0.1:" + port
+
+	// Without a client certificate the backend refuses the connection
+	router, err := NewRouter([]Route{{Upstream: upstream, TLS: &UpstreamTLS{CA: caPath, ServerName: "pwck8s-backend"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com/", nil))
+	if rr.Code != http.StatusBadGateway {
+		t.Errorf("Expected %d without a client certificate, got %d", http.StatusBadGateway, rr.Code)
+	}
+
+	router, err = NewRouter([]Route{{Upstream: upstream, TLS: &UpstreamTLS{
+		CA:         caPath,
+		ServerName: "pwck8s-backend",
+		ClientCert: clientCertPath,
+		ClientKey:  clientKeyPath,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com/", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "x509-proxy" {
+		t.Errorf("Expected the backend to see the proxy's certificate, got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestNewRouterUpstreamTLSInvalid(t *testing.T) {
+	if _, err := NewRouter([]Route{{Upstream: "http://backend", TLS: &UpstreamTLS{ServerName: "backend"}}}); err == nil {
+		t.Error("Expected TLS settings on an http upstream to be rejected")
+	}
+	if _, err := NewRouter([]Route{{Upstream: "https://backend", TLS: &UpstreamTLS{ClientCert: "client.crt"}}}); err == nil {
+		t.Error("Expected a client certificate without a key to be rejected")
+	}
+}
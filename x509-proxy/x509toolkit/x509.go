@@ -37,7 +37,7 @@ func GenerateCACertificate(commonName, country, organization, organizationUnit s
 		},
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		IsCA:                  true,
@@ -56,3 +56,25 @@ func GenerateCACertificate(commonName, country, organization, organizationUnit s
 
 	return cert, privKey, nil
 }
+
+// SignCertificate issues a certificate for pub from template, signed by the CA. A template without
+// serial number gets a random one, and one without validity period is valid from an hour ago for two hours.
+func SignCertificate(template *x509.Certificate, pub any, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, error) {
+	if template.SerialNumber == nil {
+		serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+		if err != nil {
+			return nil, err
+		}
+		template.SerialNumber = serialNumber
+	}
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, ca, pub, caKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(derBytes)
+}
@@ -1,7 +1,13 @@
 package x509toolkit
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"testing"
+	"time"
 )
 
 func TestGenerateCACertificate(t *testing.T) {
@@ -41,3 +47,28 @@ func TestGenerateCACertificate(t *testing.T) {
 	}
 
 }
+
+func TestSignCertificate(t *testing.T) {
+	ca, caKey, err := GenerateCACertificate("Test CA", "US", "Test Org", "Test Org Unit")
+	if err != nil {
+		t.Fatalf("Failed to generate CA certificate: %v", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := SignCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}}, &key.PublicKey, ca, caKey)
+	if err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
+	if err := cert.CheckSignatureFrom(ca); err != nil {
+		t.Fatalf("Failed to verify certificate: %v", err)
+	}
+	if cert.SerialNumber.Sign() <= 0 {
+		t.Error("Expected a random serial number")
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		t.Errorf("Expected the certificate to be valid now, valid from %s to %s", cert.NotBefore, cert.NotAfter)
+	}
+}